@@ -3,4 +3,272 @@ CREATE TABLE tasks (
   title TEXT NOT NULL,
   details TEXT,
   done BOOLEAN DEFAULT FALSE
-);
\ No newline at end of file
+);
+
+-- Login sessions; every issued JWT carries its session id (sid)
+CREATE TABLE sessions (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  ip TEXT,
+  user_agent TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  revoked_at TIMESTAMPTZ
+);
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+-- Single-use password reset tokens (only the SHA-256 hash is stored)
+CREATE TABLE password_reset_tokens (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  token_hash TEXT NOT NULL UNIQUE,
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Email verification; accounts that existed before this are trusted.
+-- Emails are stored lower-cased from now on.
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN verification_sent_at TIMESTAMPTZ;
+UPDATE users SET email_verified = TRUE;
+UPDATE users SET email = lower(trim(email));
+
+-- TOTP two-factor authentication
+ALTER TABLE users ADD COLUMN totp_secret TEXT;
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE sessions ADD COLUMN mfa BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE mfa_recovery_codes (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at TIMESTAMPTZ
+);
+CREATE INDEX mfa_recovery_codes_user_id_idx ON mfa_recovery_codes (user_id);
+
+-- Login brute-force protection
+ALTER TABLE users ADD COLUMN failed_logins INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN last_failed_login_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN locked_until TIMESTAMPTZ;
+
+CREATE TABLE login_ip_failures (
+  ip TEXT PRIMARY KEY,
+  failures INT NOT NULL DEFAULT 0,
+  last_failed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Personal access tokens for scripts and CI (only the SHA-256 hash is stored)
+CREATE TABLE personal_access_tokens (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  scopes TEXT[] NOT NULL,
+  expires_at TIMESTAMPTZ,
+  last_used_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  revoked_at TIMESTAMPTZ
+);
+CREATE INDEX personal_access_tokens_user_id_idx ON personal_access_tokens (user_id);
+
+-- External OpenID Connect identities linked to local users
+CREATE TABLE user_identities (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  issuer TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  email TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  UNIQUE (issuer, subject)
+);
+
+-- Passwordless magic-link logins (only the SHA-256 hash is stored)
+CREATE TABLE magic_link_tokens (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  token_hash TEXT NOT NULL UNIQUE,
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at TIMESTAMPTZ,
+  ip TEXT,
+  user_agent TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- WebAuthn passkeys and pending ceremony challenges
+CREATE TABLE webauthn_credentials (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  credential_id BYTEA NOT NULL UNIQUE,
+  public_key BYTEA NOT NULL,
+  sign_count BIGINT NOT NULL DEFAULT 0,
+  name TEXT NOT NULL,
+  aaguid BYTEA,
+  attestation_format TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  last_used_at TIMESTAMPTZ
+);
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
+
+CREATE TABLE webauthn_challenges (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+  challenge BYTEA NOT NULL,
+  ceremony TEXT NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Self-service profile settings and scheduled account deletion
+ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
+ALTER TABLE users ADD COLUMN locale TEXT NOT NULL DEFAULT 'en';
+ALTER TABLE users ADD COLUMN deletion_scheduled_at TIMESTAMPTZ;
+
+-- Personal data export archives
+CREATE TABLE data_exports (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  requested_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  status TEXT NOT NULL DEFAULT 'pending',
+  file_path TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  completed_at TIMESTAMPTZ,
+  expires_at TIMESTAMPTZ
+);
+
+-- Append-only audit log. actor_id has no foreign key so history
+-- survives the actor's deletion.
+CREATE TABLE audit_events (
+  id BIGSERIAL PRIMARY KEY,
+  occurred_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  actor_id UUID,
+  action TEXT NOT NULL,
+  target_type TEXT NOT NULL,
+  target_id TEXT NOT NULL,
+  before JSONB,
+  after JSONB,
+  ip TEXT,
+  user_agent TEXT
+);
+CREATE INDEX audit_events_actor_id_idx ON audit_events (actor_id);
+CREATE INDEX audit_events_target_idx ON audit_events (target_type, target_id);
+CREATE INDEX audit_events_action_idx ON audit_events (action);
+
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_no_update_delete
+  BEFORE UPDATE OR DELETE ON audit_events
+  FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+-- Ban history; users.banned stays the fast flag checked at login
+CREATE TABLE user_bans (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  banned_by UUID REFERENCES users(id) ON DELETE SET NULL,
+  reason TEXT NOT NULL DEFAULT '',
+  expires_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  lifted_at TIMESTAMPTZ,
+  lifted_by UUID REFERENCES users(id) ON DELETE SET NULL
+);
+CREATE INDEX user_bans_user_id_idx ON user_bans (user_id);
+
+-- Tasks kept when an admin deletes their owner with tasks=archive
+ALTER TABLE tasks ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE tasks ADD COLUMN archived_at TIMESTAMPTZ;
+ALTER TABLE tasks ADD COLUMN archived_owner_email TEXT;
+
+-- Soft delete: DeleteTask moves tasks to the trash, PurgeTrash empties it
+ALTER TABLE tasks ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE tasks ADD COLUMN deleted_by UUID REFERENCES users(id) ON DELETE SET NULL;
+CREATE INDEX tasks_deleted_at_idx ON tasks (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- One row per change to a task: the changed fields and the task after it
+CREATE TABLE task_revisions (
+  id BIGSERIAL PRIMARY KEY,
+  task_id UUID NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+  revision INT NOT NULL,
+  action TEXT NOT NULL,
+  actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  changes JSONB NOT NULL,
+  snapshot JSONB NOT NULL,
+  UNIQUE (task_id, revision)
+);
+
+-- Bumped on every write; the task's ETag
+ALTER TABLE tasks ADD COLUMN version INT NOT NULL DEFAULT 1;
+
+-- Typed task fields settable from JSON bodies
+ALTER TABLE tasks ADD COLUMN due_at TIMESTAMPTZ;
+ALTER TABLE tasks ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+CREATE INDEX tasks_tags_idx ON tasks USING GIN (tags);
+
+-- First response per user + Idempotency-Key, replayed on retries
+CREATE TABLE idempotency_keys (
+  scope TEXT NOT NULL,
+  key TEXT NOT NULL,
+  fingerprint TEXT NOT NULL,
+  status INT,
+  headers JSONB,
+  body BYTEA,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (scope, key)
+);
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+
+-- Id a task was imported with, for deduplicating repeated imports
+ALTER TABLE tasks ADD COLUMN external_id TEXT;
+CREATE INDEX tasks_external_id_idx ON tasks (user_id, external_id) WHERE external_id IS NOT NULL;
+
+-- How a task repeats, as an iCalendar RRULE ('' for never)
+ALTER TABLE tasks ADD COLUMN recurrence TEXT NOT NULL DEFAULT '';
+
+-- Secret iCalendar subscription URL (hash of its token)
+ALTER TABLE users ADD COLUMN calendar_token_hash TEXT UNIQUE;
+
+-- CalDAV: every task write takes the next sync_seq, so a sync-token is
+-- the highest one a client has seen; purges raise the user's floor
+CREATE SEQUENCE task_sync_seq;
+ALTER TABLE tasks ADD COLUMN sync_seq BIGINT NOT NULL DEFAULT nextval('task_sync_seq');
+ALTER TABLE tasks ADD COLUMN dav_name TEXT;
+CREATE INDEX tasks_user_sync_idx ON tasks (user_id, sync_seq);
+ALTER TABLE users ADD COLUMN dav_sync_floor BIGINT NOT NULL DEFAULT 0;
+
+-- Task priority: 'high', 'medium', 'low' or '' for none
+ALTER TABLE tasks ADD COLUMN priority TEXT NOT NULL DEFAULT '';
+
+-- New email address waiting for its verification link to be opened
+ALTER TABLE users ADD COLUMN pending_email TEXT;
+
+-- Keys whose response holds a secret record only that the request went
+-- through; a retry is refused instead of replayed
+ALTER TABLE idempotency_keys ADD COLUMN replayable BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- CalDAV sync_seq is counted per user under the users row lock, so a
+-- change only gets a number once every lower one has committed and a
+-- sync-token never skips a write still in flight
+ALTER TABLE users ADD COLUMN dav_sync_seq BIGINT NOT NULL DEFAULT 0;
+UPDATE users u SET dav_sync_seq=GREATEST(u.dav_sync_floor,
+  COALESCE((SELECT max(sync_seq) FROM tasks WHERE user_id=u.id), 0));
+ALTER TABLE tasks ALTER COLUMN sync_seq SET DEFAULT 0;
+DROP SEQUENCE task_sync_seq;
+
+CREATE FUNCTION tasks_next_sync_seq() RETURNS trigger AS $$
+BEGIN
+  IF NEW.user_id IS NOT NULL THEN
+    UPDATE users SET dav_sync_seq=dav_sync_seq+1 WHERE id=NEW.user_id
+      RETURNING dav_sync_seq INTO NEW.sync_seq;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER tasks_sync_seq
+  BEFORE INSERT OR UPDATE ON tasks
+  FOR EACH ROW EXECUTE FUNCTION tasks_next_sync_seq();
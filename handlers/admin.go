@@ -3,23 +3,32 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"task-api/db"
+	"task-api/middlewares"
 	"task-api/models"
+	"task-api/utils"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
 )
 
 func GetAllUsers(w http.ResponseWriter, r *http.Request) {
-	query := "SELECT id, name, email, role, banned FROM users WHERE 1=1"
+	query := `SELECT id, name, email, role, banned, email_verified, totp_enabled,
+	failed_logins, CASE WHEN locked_until > now() THEN locked_until END
+	FROM users WHERE 1=1`
 	args := []interface{}{}
 	argID := 1
 
 	role := r.URL.Query().Get("role")
 	email := r.URL.Query().Get("email")
+	locked := r.URL.Query().Get("locked")
 
 	if role != "" {
 		query += fmt.Sprintf(" AND role=$%d", argID)
@@ -31,10 +40,13 @@ func GetAllUsers(w http.ResponseWriter, r *http.Request) {
 		args = append(args, "%"+email+"%")
 		argID++
 	}
+	if locked == "true" {
+		query += " AND locked_until > now()"
+	}
 
 	rows, err := db.Pool.Query(context.Background(), query, args...)
 	if err != nil {
-		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		utils.Error(w, "Failed to fetch users", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
@@ -42,7 +54,8 @@ func GetAllUsers(w http.ResponseWriter, r *http.Request) {
 	var users []models.User
 	for rows.Next() {
 		var user models.User
-		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.Banned)
+		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.Banned, &user.EmailVerified, &user.TOTPEnabled,
+			&user.FailedLogins, &user.LockedUntil)
 		if err != nil {
 			continue
 		}
@@ -57,18 +70,27 @@ func GetUserByID(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	userID, err := uuid.Parse(params["id"])
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		utils.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
 	var user models.User
 	err = db.Pool.QueryRow(
 		context.Background(),
-		"SELECT id, name, email, role, banned FROM users WHERE id=$1", userID,
-	).Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.Banned)
+		`SELECT id, name, email, role, banned, email_verified, totp_enabled,
+		failed_logins, CASE WHEN locked_until > now() THEN locked_until END
+		FROM users WHERE id=$1`, userID,
+	).Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.Banned, &user.EmailVerified, &user.TOTPEnabled,
+		&user.FailedLogins, &user.LockedUntil)
+
+	if err != nil {
+		utils.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 
+	user.Bans, err = userBans(userID)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		utils.Error(w, "Failed to fetch ban history", http.StatusInternalServerError)
 		return
 	}
 
@@ -76,17 +98,25 @@ func GetUserByID(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(user)
 }
 
+// GetAllTasksWithUsers lists every task with its owner. ?archived=true
+// lists instead the tasks archived when their owner was deleted.
 func GetAllTasksWithUsers(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("archived") == "true" {
+		getArchivedTasks(w)
+		return
+	}
+
 	query := `
 	SELECT t.id, t.title, t.details, t.done, t.image_url, u.id, u.email
 	FROM tasks t
 	JOIN users u ON t.user_id = u.id
+	WHERE t.deleted_at IS NULL
 	ORDER BY t.id DESC
 	`
 
 	rows, err := db.Pool.Query(context.Background(), query)
 	if err != nil {
-		http.Error(w, "Failed to fetch tasks", http.StatusInternalServerError)
+		utils.Error(w, "Failed to fetch tasks", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
@@ -115,11 +145,46 @@ func GetAllTasksWithUsers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
+func getArchivedTasks(w http.ResponseWriter) {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id, title, details, done, image_url, archived_at, archived_owner_email
+		 FROM tasks WHERE archived_at IS NOT NULL AND deleted_at IS NULL ORDER BY archived_at DESC`)
+	if err != nil {
+		utils.Error(w, "Failed to fetch tasks", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type ArchivedTask struct {
+		ID         uuid.UUID `json:"id"`
+		Title      string    `json:"title"`
+		Details    string    `json:"details"`
+		Done       bool      `json:"done"`
+		ImageURL   string    `json:"image_url"`
+		ArchivedAt time.Time `json:"archived_at"`
+		OwnerEmail string    `json:"owner_email"`
+	}
+
+	result := []ArchivedTask{}
+	for rows.Next() {
+		var t ArchivedTask
+		err := rows.Scan(&t.ID, &t.Title, &t.Details, &t.Done, &t.ImageURL, &t.ArchivedAt, &t.OwnerEmail)
+		if err != nil {
+			utils.Error(w, "Failed to parse task", http.StatusInternalServerError)
+			return
+		}
+		result = append(result, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
 func UpdateUserRole(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id, err := uuid.Parse(params["id"])
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		utils.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
@@ -127,50 +192,258 @@ func UpdateUserRole(w http.ResponseWriter, r *http.Request) {
 		Role string `json:"role"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.Role != "admin" && body.Role != "user") {
-		http.Error(w, "Invalid role", http.StatusBadRequest)
+		utils.Error(w, "Invalid role", http.StatusBadRequest)
 		return
 	}
 
-	_, err = db.Pool.Exec(context.Background(), "UPDATE users SET role=$1 WHERE id=$2", body.Role, id)
+	var oldRole string
+	err = db.Pool.QueryRow(context.Background(),
+		`UPDATE users u SET role=$1 FROM (SELECT id, role FROM users WHERE id=$2) old
+		 WHERE u.id = old.id RETURNING old.role`,
+		body.Role, id,
+	).Scan(&oldRole)
+	if errors.Is(err, pgx.ErrNoRows) {
+		utils.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		utils.Error(w, "Failed to update role", http.StatusInternalServerError)
 		return
 	}
 
+	audit(r, middlewares.GetUserID(r), AuditRoleChanged, "user", id.String(),
+		map[string]string{"role": oldRole}, map[string]string{"role": body.Role})
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// Ways DeleteUser can dispose of the user's tasks.
+const (
+	deletionDeleteTasks   = "delete"
+	deletionTransferTasks = "transfer"
+	deletionArchiveTasks  = "archive"
+)
+
+type userDeletionPlan struct {
+	Tasks      string     `json:"tasks"`
+	TransferTo *uuid.UUID `json:"transfer_to,omitempty"`
+}
+
+// userDeletionPreview is what deleting a user would affect.
+type userDeletionPreview struct {
+	User           models.User      `json:"user"`
+	Plan           userDeletionPlan `json:"plan"`
+	TransferTo     *models.User     `json:"transfer_to,omitempty"`
+	Tasks          int              `json:"tasks"`
+	TasksDone      int              `json:"tasks_done"`
+	TasksWithImage int              `json:"tasks_with_image"`
+	TasksInTrash   int              `json:"tasks_in_trash"`
+	ActiveSessions int              `json:"active_sessions"`
+	PersonalTokens int              `json:"personal_tokens"`
+	Passkeys       int              `json:"passkeys"`
+}
+
+// parseUserDeletionPlan reads ?tasks=delete|transfer|archive and, for
+// transfer, ?transfer_to=<user id>. The default is delete.
+func parseUserDeletionPlan(r *http.Request, userID uuid.UUID) (userDeletionPlan, error) {
+	q := r.URL.Query()
+	plan := userDeletionPlan{Tasks: q.Get("tasks")}
+	if plan.Tasks == "" {
+		plan.Tasks = deletionDeleteTasks
+	}
+
+	switch plan.Tasks {
+	case deletionDeleteTasks, deletionArchiveTasks:
+		if q.Get("transfer_to") != "" {
+			return plan, errors.New("transfer_to is only allowed with tasks=transfer")
+		}
+	case deletionTransferTasks:
+		to, err := uuid.Parse(q.Get("transfer_to"))
+		if err != nil {
+			return plan, errors.New("tasks=transfer requires a valid transfer_to user ID")
+		}
+		if to == userID {
+			return plan, errors.New("Cannot transfer tasks to the user being deleted")
+		}
+		plan.TransferTo = &to
+	default:
+		return plan, errors.New("tasks must be one of delete, transfer, archive")
+	}
+	return plan, nil
+}
+
+var errTransferTargetNotFound = errors.New("transfer target not found")
+
+// previewUserDeletion counts what the plan would touch. DeleteUser runs it
+// inside its transaction (after locking the user) so the preview it
+// audits is exactly what was deleted.
+func previewUserDeletion(ctx context.Context, q db.Querier, userID uuid.UUID, plan userDeletionPlan) (userDeletionPreview, error) {
+	p := userDeletionPreview{Plan: plan}
+
+	err := q.QueryRow(ctx,
+		"SELECT id, name, email, role, banned FROM users WHERE id=$1", userID,
+	).Scan(&p.User.ID, &p.User.Name, &p.User.Email, &p.User.Role, &p.User.Banned)
+	if err != nil {
+		return p, err
+	}
+
+	if plan.TransferTo != nil {
+		var to models.User
+		err := q.QueryRow(ctx,
+			"SELECT id, name, email, role, banned FROM users WHERE id=$1 AND deletion_scheduled_at IS NULL",
+			*plan.TransferTo,
+		).Scan(&to.ID, &to.Name, &to.Email, &to.Role, &to.Banned)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return p, errTransferTargetNotFound
+		}
+		if err != nil {
+			return p, err
+		}
+		p.TransferTo = &to
+	}
+
+	err = q.QueryRow(ctx,
+		`SELECT COUNT(*) FILTER (WHERE deleted_at IS NULL),
+		 COUNT(*) FILTER (WHERE deleted_at IS NULL AND done),
+		 COUNT(*) FILTER (WHERE deleted_at IS NULL AND COALESCE(image_url, '') <> ''),
+		 COUNT(*) FILTER (WHERE deleted_at IS NOT NULL)
+		 FROM tasks WHERE user_id=$1`, userID,
+	).Scan(&p.Tasks, &p.TasksDone, &p.TasksWithImage, &p.TasksInTrash)
+	if err != nil {
+		return p, err
+	}
+
+	err = q.QueryRow(ctx,
+		`SELECT
+		 (SELECT COUNT(*) FROM sessions WHERE user_id=$1 AND revoked_at IS NULL AND last_seen_at > $2),
+		 (SELECT COUNT(*) FROM personal_access_tokens WHERE user_id=$1 AND revoked_at IS NULL),
+		 (SELECT COUNT(*) FROM webauthn_credentials WHERE user_id=$1)`,
+		userID, time.Now().Add(-sessionIdleTimeout),
+	).Scan(&p.ActiveSessions, &p.PersonalTokens, &p.Passkeys)
+	return p, err
+}
+
+// PreviewDeleteUser shows what DeleteUser would do with the same query
+// parameters, without changing anything.
+func PreviewDeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	plan, err := parseUserDeletionPlan(r, userID)
+	if err != nil {
+		utils.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	preview, err := previewUserDeletion(context.Background(), db.Pool, userID, plan)
+	if !writeDeletionError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
+
+// writeDeletionError reports err and returns false, or returns true when
+// there is nothing to report.
+func writeDeletionError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, pgx.ErrNoRows):
+		utils.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, errTransferTargetNotFound):
+		utils.Error(w, "User to transfer tasks to not found", http.StatusBadRequest)
+	default:
+		utils.Error(w, "Failed to delete user", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// DeleteUser removes a user and, in the same transaction, deletes,
+// transfers or archives their tasks (see parseUserDeletionPlan).
+// Archived tasks lose their owner and are only visible to admins.
 func DeleteUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id, err := uuid.Parse(params["id"])
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		utils.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
-	// First delete user tasks (if needed)
-	_, err = db.Pool.Exec(context.Background(), "DELETE FROM tasks WHERE user_id=$1", id)
+	plan, err := parseUserDeletionPlan(r, id)
 	if err != nil {
-		http.Error(w, "Failed to delete user tasks", http.StatusInternalServerError)
+		utils.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Then delete user
-	_, err = db.Pool.Exec(context.Background(), "DELETE FROM users WHERE id=$1", id)
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
 	if err != nil {
-		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		utils.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock both users so neither disappears mid-transfer
+	_, err = tx.Exec(ctx, "SELECT 1 FROM users WHERE id = ANY($1) FOR UPDATE", []uuid.UUID{id, derefUUID(plan.TransferTo)})
+	if err != nil {
+		utils.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	preview, err := previewUserDeletion(ctx, tx, id, plan)
+	if !writeDeletionError(w, err) {
+		return
+	}
+
+	switch plan.Tasks {
+	case deletionTransferTasks:
+		_, err = tx.Exec(ctx, "UPDATE tasks SET user_id=$1, version=version+1 WHERE user_id=$2", *plan.TransferTo, id)
+	case deletionArchiveTasks:
+		_, err = tx.Exec(ctx,
+			"UPDATE tasks SET user_id=NULL, archived_at=now(), archived_owner_email=$1, version=version+1 WHERE user_id=$2",
+			preview.User.Email, id,
+		)
+	default:
+		_, err = tx.Exec(ctx, "DELETE FROM tasks WHERE user_id=$1", id)
+	}
+	if err != nil {
+		utils.Error(w, "Failed to "+plan.Tasks+" user tasks", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM users WHERE id=$1", id); err != nil {
+		utils.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		utils.Error(w, "Failed to delete user", http.StatusInternalServerError)
 		return
 	}
 
+	audit(r, middlewares.GetUserID(r), AuditUserDeleted, "user", id.String(), preview, nil)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func derefUUID(id *uuid.UUID) uuid.UUID {
+	if id == nil {
+		return uuid.Nil
+	}
+	return *id
+}
+
 func GetAdminStats(w http.ResponseWriter, r *http.Request) {
 	var users, admins, tasks int
 
 	_ = db.Pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM users").Scan(&users)
 	_ = db.Pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM users WHERE role='admin'").Scan(&admins)
-	_ = db.Pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM tasks").Scan(&tasks)
+	_ = db.Pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM tasks WHERE deleted_at IS NULL").Scan(&tasks)
 
 	stats := map[string]int{
 		"total_users": users,
@@ -182,28 +455,92 @@ func GetAdminStats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(stats)
 }
 
+// ToggleBanUser bans (optionally until expires_at, with a reason) or
+// reinstates a user. Every ban is kept as history.
 func ToggleBanUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	userID, err := uuid.Parse(params["id"])
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		utils.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
 	var body struct {
-		Banned bool `json:"banned"`
+		Banned    bool       `json:"banned"`
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expires_at"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if body.Banned && body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+		utils.Error(w, "expires_at must be in the future", http.StatusBadRequest)
 		return
 	}
 
-	_, err = db.Pool.Exec(context.Background(), "UPDATE users SET banned=$1 WHERE id=$2", body.Banned, userID)
+	adminID := middlewares.GetUserID(r)
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
 	if err != nil {
-		http.Error(w, "Failed to update banned status", http.StatusInternalServerError)
+		utils.Error(w, "Failed to update banned status", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback(ctx)
+
+	var wasBanned bool
+	err = tx.QueryRow(ctx, "SELECT banned FROM users WHERE id=$1 FOR UPDATE", userID).Scan(&wasBanned)
+	if errors.Is(err, pgx.ErrNoRows) {
+		utils.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Error(w, "Failed to update banned status", http.StatusInternalServerError)
+		return
+	}
+
+	// A new ban replaces the current one; unbanning just lifts it
+	_, err = tx.Exec(ctx,
+		"UPDATE user_bans SET lifted_at=now(), lifted_by=$1 WHERE user_id=$2 AND lifted_at IS NULL",
+		adminID, userID,
+	)
+	if err != nil {
+		utils.Error(w, "Failed to update banned status", http.StatusInternalServerError)
+		return
+	}
+
+	if body.Banned {
+		_, err = tx.Exec(ctx,
+			"INSERT INTO user_bans (user_id, banned_by, reason, expires_at) VALUES ($1, $2, $3, $4)",
+			userID, adminID, strings.TrimSpace(body.Reason), body.ExpiresAt,
+		)
+		if err == nil {
+			err = revokeSessions(ctx, tx, userID)
+		}
+		if err != nil {
+			utils.Error(w, "Failed to update banned status", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE users SET banned=$1 WHERE id=$2", body.Banned, userID); err != nil {
+		utils.Error(w, "Failed to update banned status", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		utils.Error(w, "Failed to update banned status", http.StatusInternalServerError)
+		return
+	}
+
+	after := map[string]interface{}{"banned": body.Banned}
+	if body.Banned {
+		after["reason"] = strings.TrimSpace(body.Reason)
+		after["expires_at"] = body.ExpiresAt
+	}
+	audit(r, adminID, AuditBanChanged, "user", userID.String(), map[string]bool{"banned": wasBanned}, after)
 
 	w.WriteHeader(http.StatusNoContent)
 }
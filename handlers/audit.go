@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"task-api/db"
+	"task-api/models"
+	"task-api/utils"
+)
+
+// Audit actions. Keep these stable: they are what admins filter on.
+const (
+	AuditLogin          = "auth.login"
+	AuditLoginFailed    = "auth.login_failed"
+	AuditTokenRefreshed = "auth.token_refreshed"
+	AuditTokenCreated   = "token.created"
+	AuditTokenRevoked   = "token.revoked"
+	AuditRoleChanged    = "user.role_changed"
+	AuditBanChanged     = "user.ban_changed"
+	AuditUserDeleted    = "user.deleted"
+	AuditUserExported   = "user.exported"
+	AuditTaskDeleted    = "task.deleted"
+	AuditTaskRestored   = "task.restored"
+	AuditTaskPurged     = "task.purged"
+	AuditTasksImported  = "task.imported"
+)
+
+// audit appends an event. Failures are logged, never surfaced: the
+// action being audited has already happened. before/after may be nil.
+func audit(r *http.Request, actorID uuid.UUID, action, targetType, targetID string, before, after interface{}) {
+	var actor *uuid.UUID
+	if actorID != uuid.Nil {
+		actor = &actorID
+	}
+
+	_, err := db.Pool.Exec(context.Background(),
+		`INSERT INTO audit_events (actor_id, action, target_type, target_id, before, after, ip, user_agent)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		actor, action, targetType, targetID, auditJSON(before), auditJSON(after), clientIP(r), r.UserAgent(),
+	)
+	if err != nil {
+		log.Printf("audit %s error: %v", action, err)
+	}
+}
+
+func auditJSON(v interface{}) []byte {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// GetAuditEvents lists events newest first. Filters: actor_id, action,
+// target_type, target_id, since, until (RFC 3339). Pages with limit and
+// the next_cursor from the previous page; format=jsonl streams every
+// match as JSON lines instead.
+func GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := `SELECT id, occurred_at, actor_id, action, target_type, target_id, before, after,
+	COALESCE(ip, ''), COALESCE(user_agent, '') FROM audit_events WHERE 1=1`
+	args := []interface{}{}
+	argID := 1
+
+	addFilter := func(clause string, value interface{}) {
+		query += fmt.Sprintf(" AND "+clause, argID)
+		args = append(args, value)
+		argID++
+	}
+
+	if actor := q.Get("actor_id"); actor != "" {
+		id, err := uuid.Parse(actor)
+		if err != nil {
+			utils.Error(w, "Invalid actor_id", http.StatusBadRequest)
+			return
+		}
+		addFilter("actor_id=$%d", id)
+	}
+	if action := q.Get("action"); action != "" {
+		addFilter("action=$%d", action)
+	}
+	if targetType := q.Get("target_type"); targetType != "" {
+		addFilter("target_type=$%d", targetType)
+	}
+	if targetID := q.Get("target_id"); targetID != "" {
+		addFilter("target_id=$%d", targetID)
+	}
+	for param, clause := range map[string]string{"since": "occurred_at >= $%d", "until": "occurred_at < $%d"} {
+		if v := q.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				utils.Error(w, "Invalid "+param+", expected RFC 3339", http.StatusBadRequest)
+				return
+			}
+			addFilter(clause, t)
+		}
+	}
+
+	jsonLines := q.Get("format") == "jsonl"
+
+	limit := 50
+	if !jsonLines {
+		if cursor := q.Get("cursor"); cursor != "" {
+			id, err := strconv.ParseInt(cursor, 10, 64)
+			if err != nil {
+				utils.Error(w, "Invalid cursor", http.StatusBadRequest)
+				return
+			}
+			addFilter("id < $%d", id)
+		}
+		if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+			limit = min(l, 500)
+		}
+		query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+	} else {
+		query += " ORDER BY id DESC"
+	}
+
+	rows, err := db.Pool.Query(context.Background(), query, args...)
+	if err != nil {
+		utils.Error(w, "Failed to fetch audit events", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	if jsonLines {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	}
+	enc := json.NewEncoder(w)
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var e models.AuditEvent
+		err := rows.Scan(&e.ID, &e.OccurredAt, &e.ActorID, &e.Action, &e.TargetType, &e.TargetID,
+			&e.Before, &e.After, &e.IP, &e.UserAgent)
+		if err != nil {
+			if !jsonLines {
+				utils.Error(w, "Failed to parse audit event", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if jsonLines {
+			enc.Encode(e)
+			continue
+		}
+		events = append(events, e)
+	}
+
+	if jsonLines {
+		return
+	}
+
+	resp := map[string]interface{}{"events": events}
+	if len(events) == limit {
+		resp["next_cursor"] = strconv.FormatInt(events[len(events)-1].ID, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc.Encode(resp)
+}
@@ -7,14 +7,15 @@ import (
 	"net/http"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	// "github.com/google/uuid"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 
 	"task-api/db"
+	"task-api/middlewares"
 	"task-api/models"
+	"task-api/utils"
 )
 
 type AuthRequest struct {
@@ -25,66 +26,92 @@ type AuthRequest struct {
 func Login(w http.ResponseWriter, r *http.Request) {
 	var req AuthRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	if wait := ipRetryAfter(ip); wait > 0 {
+		tooManyRequests(w, wait, "Too many failed login attempts, try again later")
 		return
 	}
 
 	var user models.User
 	err := db.Pool.QueryRow(
 		context.Background(),
-		"SELECT id, password, role, banned FROM users WHERE email=$1",
-		req.Email,
-	).Scan(&user.ID, &user.Password, &user.Role, &user.Banned)
+		"SELECT id, password, role, banned, email_verified, totp_enabled FROM users WHERE email=$1",
+		strings.ToLower(strings.TrimSpace(req.Email)),
+	).Scan(&user.ID, &user.Password, &user.Role, &user.Banned, &user.EmailVerified, &user.TOTPEnabled)
 
 	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		recordIPFailure(ip)
+		audit(r, uuid.Nil, AuditLoginFailed, "email", strings.ToLower(strings.TrimSpace(req.Email)), nil, nil)
+		utils.ErrorCode(w, "Invalid credentials", http.StatusUnauthorized, "invalid_credentials")
 		return
 	}
 
-	if user.Banned {
-		http.Error(w, "Your account has been banned", http.StatusForbidden)
+	// Checked before bcrypt so throttled attempts cost us nothing
+	if wait, locked := accountRetryAfter(user.ID); wait > 0 {
+		msg := "Too many failed login attempts, try again later"
+		if locked {
+			msg = "Account temporarily locked after too many failed login attempts"
+		}
+		tooManyRequests(w, wait, msg)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		recordLoginFailure(user.ID, ip)
+		audit(r, uuid.Nil, AuditLoginFailed, "user", user.ID.String(), nil, map[string]string{"reason": "password"})
+		utils.ErrorCode(w, "Invalid credentials", http.StatusUnauthorized, "invalid_credentials")
 		return
 	}
 
-	// 🔐 Generate JWT with UUID as string
-	secret := os.Getenv("JWT_SECRET")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID.String(),
-		"role":    user.Role,
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-	})
+	// Only reveal the ban reason to someone who knows the password
+	if user.Banned {
+		writeBanned(w, user.ID)
+		return
+	}
 
-	tokenString, err := token.SignedString([]byte(secret))
-	if err != nil {
-		http.Error(w, "Token error", http.StatusInternalServerError)
+	if !user.EmailVerified && middlewares.UnverifiedPolicy() == middlewares.UnverifiedBlock {
+		utils.ErrorCode(w, "Please verify your email address before logging in", http.StatusForbidden, "email_unverified")
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	if user.TOTPEnabled {
+		mfaChallenge(w, user)
+		return
+	}
+
+	resetLoginFailures(user.ID)
+
+	issueToken(w, r, user, false)
 }
 
 func Signup(w http.ResponseWriter, r *http.Request) {
 	var user models.User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
 	user.Name = strings.TrimSpace(user.Name)
 	user.Email = strings.TrimSpace(user.Email)
 	if user.Name == "" || user.Email == "" || user.Password == "" {
-		http.Error(w, "All fields are required", http.StatusBadRequest)
+		utils.Error(w, "All fields are required", http.StatusBadRequest)
+		return
+	}
+
+	email, err := utils.NormalizeEmail(user.Email)
+	if err != nil {
+		utils.Error(w, "Invalid email address", http.StatusBadRequest)
 		return
 	}
+	user.Email = email
 
 	hashed, err := bcrypt.GenerateFromPassword([]byte(user.Password), 14)
 	if err != nil {
-		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		utils.Error(w, "Error hashing password", http.StatusInternalServerError)
 		return
 	}
 
@@ -98,15 +125,19 @@ func Signup(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		// ✅ Check if it's a unique constraint violation
 		if strings.Contains(err.Error(), "duplicate key value") {
-			http.Error(w, "Email already registered", http.StatusConflict)
+			utils.ErrorCode(w, "Email already registered", http.StatusConflict, "email_taken")
 			return
 		}
 
 		log.Printf("Signup error: %v", err)
-		http.Error(w, "User creation failed", http.StatusInternalServerError)
+		utils.Error(w, "User creation failed", http.StatusInternalServerError)
 		return
 	}
 
+	if err := sendVerificationEmail(user.ID, user.Email); err != nil {
+		log.Printf("Signup verification email error: %v", err)
+	}
+
 	user.Password = ""
 	json.NewEncoder(w).Encode(user)
 }
@@ -114,7 +145,7 @@ func Signup(w http.ResponseWriter, r *http.Request) {
 func RefreshToken(w http.ResponseWriter, r *http.Request) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
+		utils.Error(w, "Missing token", http.StatusUnauthorized)
 		return
 	}
 
@@ -126,36 +157,33 @@ func RefreshToken(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		utils.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+		utils.Error(w, "Invalid token claims", http.StatusUnauthorized)
 		return
 	}
 
 	userID, ok := claims["user_id"].(string)
 	role, ok2 := claims["role"].(string)
+	sessionID, ok3 := claims["sid"].(string)
 
-	if !ok || !ok2 {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	if !ok || !ok2 || !ok3 {
+		utils.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
 
-	// Issue new token
-	newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": userID,
-		"role":    role,
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-	})
-
-	tokenString, err := newToken.SignedString([]byte(secret))
+	// Issue new token for the same session
+	tokenString, err := signToken(userID, role, sessionID)
 	if err != nil {
-		http.Error(w, "Token generation failed", http.StatusInternalServerError)
+		utils.Error(w, "Token generation failed", http.StatusInternalServerError)
 		return
 	}
 
+	audit(r, middlewares.GetUserID(r), AuditTokenRefreshed, "session", sessionID, nil, nil)
+
 	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
 }
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"task-api/db"
+	"task-api/models"
+	"task-api/utils"
+)
+
+// writeBanned explains a ban in the 403 sent to a banned user trying to
+// log in, including the reason and when it ends.
+func writeBanned(w http.ResponseWriter, userID uuid.UUID) {
+	var reason string
+	var expiresAt *time.Time
+	err := db.Pool.QueryRow(context.Background(),
+		`SELECT reason, expires_at FROM user_bans
+		 WHERE user_id=$1 AND lifted_at IS NULL
+		 ORDER BY created_at DESC LIMIT 1`,
+		userID,
+	).Scan(&reason, &expiresAt)
+
+	msg := "Your account has been banned"
+	if err == nil {
+		if expiresAt != nil {
+			msg += " until " + expiresAt.UTC().Format(time.RFC3339)
+		}
+		if reason != "" {
+			msg += fmt.Sprintf(". Reason: %s", reason)
+		}
+	}
+
+	utils.ErrorCode(w, msg, http.StatusForbidden, "account_banned")
+}
+
+func userBans(userID uuid.UUID) ([]models.Ban, error) {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id, reason, banned_by, expires_at, created_at, lifted_at, lifted_by
+		 FROM user_bans WHERE user_id=$1 ORDER BY created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := []models.Ban{}
+	for rows.Next() {
+		var b models.Ban
+		if err := rows.Scan(&b.ID, &b.Reason, &b.BannedBy, &b.ExpiresAt, &b.CreatedAt, &b.LiftedAt, &b.LiftedBy); err != nil {
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+// LiftExpiredBans reinstates users whose temporary ban has run out. It
+// runs on a schedule from main.
+func LiftExpiredBans() error {
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`UPDATE user_bans SET lifted_at=now()
+		 WHERE lifted_at IS NULL AND expires_at <= now()
+		 RETURNING user_id`)
+	if err != nil {
+		return err
+	}
+
+	var userIDs []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	// Another, longer ban may still be in force
+	_, err = tx.Exec(ctx,
+		`UPDATE users SET banned=FALSE
+		 WHERE id = ANY($1)
+		   AND NOT EXISTS (SELECT 1 FROM user_bans b WHERE b.user_id = users.id AND b.lifted_at IS NULL)`,
+		userIDs,
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Lifted %d expired bans", len(userIDs))
+	return tx.Commit(ctx)
+}
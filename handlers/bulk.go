@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+const (
+	maxBulkOperations = 50
+	maxBulkTasks      = 500
+)
+
+// Bulk operations
+const (
+	bulkUpdate    = "update"     // merge-patch the task with fields
+	bulkSetDone   = "set_done"   // set done to the given value
+	bulkAddTag    = "add_tag"    // add tag
+	bulkRemoveTag = "remove_tag" // remove tag
+	bulkDelete    = "delete"     // move to the trash
+)
+
+// Per-task outcomes
+const (
+	bulkOK         = "ok"
+	bulkFailed     = "failed"
+	bulkRolledBack = "rolled_back"
+	bulkSkipped    = "skipped"
+)
+
+var (
+	errTaskNotFound  = errors.New("task not found")
+	errTaskForbidden = errors.New("not authorized to change this task")
+)
+
+// bulkFilter selects the caller's own live tasks. Every set field must
+// match.
+type bulkFilter struct {
+	Done      *bool      `json:"done"`
+	Tag       string     `json:"tag"`
+	Search    string     `json:"search"`
+	DueBefore *time.Time `json:"due_before"`
+	DueAfter  *time.Time `json:"due_after"`
+}
+
+// bulkOperation applies one op to either ids or the tasks matching
+// filter.
+type bulkOperation struct {
+	Op     string          `json:"op"`
+	IDs    []uuid.UUID     `json:"ids"`
+	Filter *bulkFilter     `json:"filter"`
+	Fields json.RawMessage `json:"fields"`
+	Done   *bool           `json:"done"`
+	Tag    string          `json:"tag"`
+}
+
+type bulkResult struct {
+	Op     int          `json:"op"`
+	ID     uuid.UUID    `json:"id"`
+	Status string       `json:"status"`
+	Error  string       `json:"error,omitempty"`
+	Fields fieldErrors  `json:"fields,omitempty"`
+	Task   *models.Task `json:"task,omitempty"`
+}
+
+// BulkTasks applies a list of operations in one transaction. Each task
+// change runs in its own savepoint: by default a failed item is reported
+// and the rest still apply; with "atomic": true the first failure rolls
+// everything back and the response is 409.
+func BulkTasks(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Operations []bulkOperation `json:"operations"`
+		Atomic     bool            `json:"atomic"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if errs := validateBulk(body.Operations); len(errs) > 0 {
+		utils.ValidationError(w, "Invalid bulk request", errs)
+		return
+	}
+
+	userID := middlewares.GetUserID(r)
+	// Other users' tasks need everything RequireAdmin asks for, 2FA
+	// included; an admin without it only reaches their own
+	isAdmin := middlewares.ActsAsAdmin(r)
+
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Bulk operation failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+	if err := lockSyncSeq(ctx, tx, userID); err != nil {
+		utils.Error(w, "Bulk operation failed", http.StatusInternalServerError)
+		return
+	}
+
+	targets := make([][]uuid.UUID, len(body.Operations))
+	total := 0
+	for i, op := range body.Operations {
+		if targets[i], err = bulkTargets(ctx, tx, op, userID); err != nil {
+			utils.Error(w, "Bulk operation failed", http.StatusInternalServerError)
+			return
+		}
+		total += len(targets[i])
+	}
+	if total > maxBulkTasks {
+		utils.Error(w, fmt.Sprintf("A bulk request can change at most %d tasks, this one matches %d", maxBulkTasks, total),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := []bulkResult{}
+	failed := false
+	for i, op := range body.Operations {
+		for _, id := range targets[i] {
+			res := bulkResult{Op: i, ID: id}
+			if failed && body.Atomic {
+				res.Status = bulkSkipped
+				results = append(results, res)
+				continue
+			}
+
+			task, fields, err := applyBulkItem(ctx, tx, op, id, userID, isAdmin)
+			switch {
+			case err == nil && len(fields) == 0:
+				res.Status = bulkOK
+				res.Task = &task
+			case errors.Is(err, errTaskNotFound), errors.Is(err, errTaskForbidden):
+				res.Status, res.Error = bulkFailed, err.Error()
+			case err == nil:
+				res.Status, res.Error, res.Fields = bulkFailed, "invalid task", fields
+			default:
+				utils.Error(w, "Bulk operation failed", http.StatusInternalServerError)
+				return
+			}
+			failed = failed || res.Status == bulkFailed
+			results = append(results, res)
+		}
+	}
+
+	if failed && body.Atomic {
+		for i := range results {
+			if results[i].Status == bulkOK {
+				results[i].Status, results[i].Task = bulkRolledBack, nil
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"committed": false, "results": results})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		utils.Error(w, "Bulk operation failed", http.StatusInternalServerError)
+		return
+	}
+
+	for _, res := range results {
+		if res.Status == bulkOK && body.Operations[res.Op].Op == bulkDelete {
+			audit(r, userID, AuditTaskDeleted, "task", res.ID.String(), res.Task, nil)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"committed": true, "results": results})
+}
+
+func validateBulk(ops []bulkOperation) fieldErrors {
+	errs := fieldErrors{}
+	if len(ops) == 0 || len(ops) > maxBulkOperations {
+		errs["operations"] = fmt.Sprintf("must have between 1 and %d entries", maxBulkOperations)
+		return errs
+	}
+
+	for i, op := range ops {
+		field := func(name string) string { return fmt.Sprintf("operations[%d].%s", i, name) }
+
+		if (len(op.IDs) == 0) == (op.Filter == nil) {
+			errs[field("ids")] = "give either ids or filter"
+		}
+
+		switch op.Op {
+		case bulkDelete:
+		case bulkUpdate:
+			var fields map[string]interface{}
+			if json.Unmarshal(op.Fields, &fields) != nil {
+				errs[field("fields")] = "must be an object of task fields"
+			}
+		case bulkSetDone:
+			if op.Done == nil {
+				errs[field("done")] = "is required"
+			}
+		case bulkAddTag, bulkRemoveTag:
+			if msg := tagError(normalizeTag(op.Tag)); msg != "" {
+				errs[field("tag")] = msg
+			}
+		default:
+			errs[field("op")] = "must be one of update, set_done, add_tag, remove_tag, delete"
+		}
+	}
+	return errs
+}
+
+// bulkTargets resolves an operation to task ids. Explicit ids are
+// checked later, per task; a filter only ever matches the caller's own
+// tasks.
+func bulkTargets(ctx context.Context, tx pgx.Tx, op bulkOperation, userID uuid.UUID) ([]uuid.UUID, error) {
+	if op.Filter == nil {
+		seen := map[uuid.UUID]bool{}
+		ids := []uuid.UUID{}
+		for _, id := range op.IDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+
+	query := "SELECT id FROM tasks WHERE user_id=$1 AND deleted_at IS NULL AND archived_at IS NULL"
+	args := []interface{}{userID}
+	argID := 2
+	addFilter := func(clause string, value interface{}) {
+		query += fmt.Sprintf(" AND "+clause, argID)
+		args = append(args, value)
+		argID++
+	}
+
+	f := op.Filter
+	if f.Done != nil {
+		addFilter("done=$%d", *f.Done)
+	}
+	if f.Tag != "" {
+		addFilter("$%d = ANY(tags)", normalizeTag(f.Tag))
+	}
+	if f.Search != "" {
+		query += fmt.Sprintf(" AND (title ILIKE $%d OR details ILIKE $%d)", argID, argID)
+		args = append(args, "%"+f.Search+"%")
+		argID++
+	}
+	if f.DueBefore != nil {
+		addFilter("due_at < $%d", *f.DueBefore)
+	}
+	if f.DueAfter != nil {
+		addFilter("due_at >= $%d", *f.DueAfter)
+	}
+	query += fmt.Sprintf(" ORDER BY id LIMIT %d", maxBulkTasks+1)
+
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+}
+
+// applyBulkItem applies op to one task inside a savepoint. Validation
+// problems come back as field errors with a nil error.
+func applyBulkItem(ctx context.Context, tx pgx.Tx, op bulkOperation, id, userID uuid.UUID, isAdmin bool) (models.Task, fieldErrors, error) {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return models.Task{}, nil, err
+	}
+	defer sp.Rollback(ctx)
+
+	before, err := lockTask(ctx, sp, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return before, nil, errTaskNotFound
+	}
+	if err != nil {
+		return before, nil, err
+	}
+	if !isAdmin && before.UserID != userID {
+		return before, nil, errTaskForbidden
+	}
+
+	var task models.Task
+	if op.Op == bulkDelete {
+		task, err = trashTask(ctx, sp, userID, before)
+	} else {
+		f, errs, ferr := bulkFields(op, before)
+		if ferr != nil || len(errs) > 0 {
+			return before, errs, ferr
+		}
+		task, err = saveTask(ctx, sp, userID, RevisionUpdated, before, f)
+	}
+	if err != nil {
+		return task, nil, err
+	}
+	return task, nil, sp.Commit(ctx)
+}
+
+// bulkFields is the task's fields after a non-delete op, validated.
+func bulkFields(op bulkOperation, before models.Task) (taskFields, fieldErrors, error) {
+	f := fieldsOf(before)
+	errs := fieldErrors{}
+
+	switch op.Op {
+	case bulkUpdate:
+		doc, err := json.Marshal(f)
+		if err != nil {
+			return f, nil, err
+		}
+		if doc, err = utils.MergePatch(doc, op.Fields); err != nil {
+			return f, nil, err
+		}
+		if f, errs, err = decodeTaskJSON(bytes.NewReader(doc)); err != nil {
+			return f, nil, err
+		}
+	case bulkSetDone:
+		f.Done = *op.Done
+	case bulkAddTag:
+		f.Tags = append(f.Tags, op.Tag)
+	case bulkRemoveTag:
+		tag := normalizeTag(op.Tag)
+		kept := []string{}
+		for _, t := range f.Tags {
+			if t != tag {
+				kept = append(kept, t)
+			}
+		}
+		f.Tags = kept
+	}
+
+	f.validateOver(before.ImageURL, errs)
+	return f, errs, nil
+}
@@ -0,0 +1,900 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+// CalDAV (RFC 4791) serves each user's tasks as one VTODO calendar:
+//
+//	/dav/                        root, points at the principal
+//	/dav/{user}/                 principal and calendar home
+//	/dav/{user}/tasks/           the calendar collection
+//	/dav/{user}/tasks/{name}     one task
+//
+// A task's resource name is the one a client PUT it under, or its id
+// plus ".ics"; its UID is its external id, or its id. Every write gives
+// the task the next of its owner's dav_sync_seq (a trigger does it, see
+// db-table.sql), which is the collection's sync-token; purging a task
+// from the trash raises the user's dav_sync_floor, below which tokens
+// are no longer valid.
+
+const (
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+	nsCS     = "http://calendarserver.org/ns/"
+)
+
+var davPrefixes = map[string]string{nsDAV: "D", nsCalDAV: "C", nsCS: "CS"}
+
+var (
+	davResourceType   = xml.Name{Space: nsDAV, Local: "resourcetype"}
+	davDisplayName    = xml.Name{Space: nsDAV, Local: "displayname"}
+	davGetETag        = xml.Name{Space: nsDAV, Local: "getetag"}
+	davGetContentType = xml.Name{Space: nsDAV, Local: "getcontenttype"}
+	davSyncToken      = xml.Name{Space: nsDAV, Local: "sync-token"}
+	davUserPrincipal  = xml.Name{Space: nsDAV, Local: "current-user-principal"}
+	davPrincipalURL   = xml.Name{Space: nsDAV, Local: "principal-URL"}
+	davOwner          = xml.Name{Space: nsDAV, Local: "owner"}
+	davPrivileges     = xml.Name{Space: nsDAV, Local: "current-user-privilege-set"}
+	davReportSet      = xml.Name{Space: nsDAV, Local: "supported-report-set"}
+	davHomeSet        = xml.Name{Space: nsCalDAV, Local: "calendar-home-set"}
+	davComponentSet   = xml.Name{Space: nsCalDAV, Local: "supported-calendar-component-set"}
+	davCalendarData   = xml.Name{Space: nsCalDAV, Local: "calendar-data"}
+	davCTag           = xml.Name{Space: nsCS, Local: "getctag"}
+)
+
+// davTask is a task as a calendar object.
+type davTask struct {
+	models.Task
+	UID     string
+	Name    string
+	SyncSeq int64
+	Trashed bool
+}
+
+const davTaskColumns = taskColumns + `, COALESCE(external_id, id::text), COALESCE(dav_name, id::text || '.ics'),
+	sync_seq, deleted_at IS NOT NULL`
+
+// davTasks loads the user's tasks matching where, which may use $2 on.
+// Archived tasks have no owner, so they never show up.
+func davTasks(ctx context.Context, q db.Querier, userID uuid.UUID, where string, args ...interface{}) ([]davTask, error) {
+	rows, err := q.Query(ctx,
+		"SELECT "+davTaskColumns+" FROM tasks WHERE user_id=$1 AND "+where+" ORDER BY id",
+		append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []davTask{}
+	for rows.Next() {
+		var t davTask
+		if err := scanTask(rows, &t.Task, &t.UID, &t.Name, &t.SyncSeq, &t.Trashed); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// davTaskByName loads a live task by resource name, locking it when q is
+// a transaction.
+func davTaskByName(ctx context.Context, q db.Querier, userID uuid.UUID, name string, lock bool) (davTask, error) {
+	where := "deleted_at IS NULL AND archived_at IS NULL AND COALESCE(dav_name, id::text || '.ics')=$2"
+	if lock {
+		where += " FOR UPDATE"
+	}
+	var t davTask
+	err := scanTask(q.QueryRow(ctx,
+		"SELECT "+davTaskColumns+" FROM tasks WHERE user_id=$1 AND "+where, userID, name,
+	), &t.Task, &t.UID, &t.Name, &t.SyncSeq, &t.Trashed)
+	return t, err
+}
+
+func davHomeHref(userID uuid.UUID) string {
+	return "/dav/" + userID.String() + "/"
+}
+
+func davCollectionHref(userID uuid.UUID) string {
+	return davHomeHref(userID) + "tasks/"
+}
+
+func davObjectHref(userID uuid.UUID, name string) string {
+	return davCollectionHref(userID) + url.PathEscape(name)
+}
+
+// Sync tokens are URIs ending in the sync_seq they were issued at.
+func formatSyncToken(seq int64) string {
+	return appURL() + "/dav/sync/" + strconv.FormatInt(seq, 10)
+}
+
+func parseSyncToken(token string) (int64, bool) {
+	i := strings.LastIndex(token, "/sync/")
+	if i < 0 {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(token[i+len("/sync/"):], 10, 64)
+	return seq, err == nil && seq >= 0
+}
+
+// currentSyncSeq is the collection's state: the number of the user's
+// last committed task change.
+func currentSyncSeq(ctx context.Context, userID uuid.UUID) (seq, floor int64, err error) {
+	err = db.Pool.QueryRow(ctx,
+		"SELECT dav_sync_seq, dav_sync_floor FROM users WHERE id=$1", userID,
+	).Scan(&seq, &floor)
+	return seq, floor, err
+}
+
+// raiseSyncFloor is called when tasks are purged: a purge leaves nothing
+// for sync-collection to report, so tokens from before the purged task
+// was trashed stop being valid and clients fall back to a full sync.
+func raiseSyncFloor(userID uuid.UUID, seq int64) error {
+	_, err := db.Pool.Exec(context.Background(),
+		"UPDATE users SET dav_sync_floor=GREATEST(dav_sync_floor, $2) WHERE id=$1", userID, seq)
+	return err
+}
+
+// lockSyncSeq takes the user's row lock, which the trigger numbering
+// their task writes waits on, before a transaction locks several tasks:
+// taken in the other order it could deadlock with a single-task write.
+func lockSyncSeq(ctx context.Context, q db.Querier, userID uuid.UUID) error {
+	_, err := q.Exec(ctx, "SELECT 1 FROM users WHERE id=$1 FOR NO KEY UPDATE", userID)
+	return err
+}
+
+// davResource is an href and its properties, each rendered as inner XML
+// when asked for.
+type davResource struct {
+	href  string
+	props map[xml.Name]func() string
+}
+
+func davValue(inner string) func() string {
+	return func() string { return inner }
+}
+
+func davHref(href string) func() string {
+	return davValue("<D:href>" + davEscape(href) + "</D:href>")
+}
+
+func davEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func davPrivilegeSet(r *http.Request) func() string {
+	privileges := "<D:privilege><D:read/></D:privilege>"
+	if middlewares.HasScope(r, middlewares.ScopeTasksWrite) {
+		privileges += "<D:privilege><D:write/></D:privilege><D:privilege><D:write-content/></D:privilege>" +
+			"<D:privilege><D:bind/></D:privilege><D:privilege><D:unbind/></D:privilege>"
+	}
+	return davValue(privileges)
+}
+
+func davRootResource(r *http.Request) davResource {
+	userID := middlewares.GetUserID(r)
+	return davResource{href: "/dav/", props: map[xml.Name]func() string{
+		davResourceType:  davValue("<D:collection/>"),
+		davUserPrincipal: davHref(davHomeHref(userID)),
+	}}
+}
+
+func davHomeResource(r *http.Request) davResource {
+	userID := middlewares.GetUserID(r)
+	home := davHomeHref(userID)
+	return davResource{href: home, props: map[xml.Name]func() string{
+		davResourceType:  davValue("<D:collection/><D:principal/>"),
+		davUserPrincipal: davHref(home),
+		davPrincipalURL:  davHref(home),
+		davHomeSet:       davHref(home),
+	}}
+}
+
+func davCollectionResource(r *http.Request, syncSeq int64) davResource {
+	userID := middlewares.GetUserID(r)
+	token := davValue(davEscape(formatSyncToken(syncSeq)))
+	return davResource{href: davCollectionHref(userID), props: map[xml.Name]func() string{
+		davResourceType:  davValue("<D:collection/><C:calendar/>"),
+		davDisplayName:   davValue("Tasks"),
+		davComponentSet:  davValue(`<C:comp name="VTODO"/>`),
+		davSyncToken:     token,
+		davCTag:          token,
+		davUserPrincipal: davHref(davHomeHref(userID)),
+		davOwner:         davHref(davHomeHref(userID)),
+		davPrivileges:    davPrivilegeSet(r),
+		davReportSet: davValue("<D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report>" +
+			"<D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report>" +
+			"<D:supported-report><D:report><D:sync-collection/></D:report></D:supported-report>"),
+	}}
+}
+
+func davObjectResource(r *http.Request, t davTask) davResource {
+	return davResource{href: davObjectHref(t.UserID, t.Name), props: map[xml.Name]func() string{
+		davResourceType:   davValue(""),
+		davGetETag:        davValue(davEscape(t.ETag)),
+		davGetContentType: davValue("text/calendar; charset=utf-8; component=VTODO"),
+		davPrivileges:     davPrivilegeSet(r),
+		davCalendarData:   func() string { return davEscape(davCalendarObject(t)) },
+	}}
+}
+
+// davCalendarObject is the task as a calendar holding one VTODO.
+func davCalendarObject(t davTask) string {
+	cal := taskCalendar()
+	rec := taskRecord{ExternalID: t.UID, taskFields: fieldsOf(t.Task)}
+	cal.Components = append(cal.Components, icalTodo(rec, utils.ICalTime(time.Now())))
+
+	var b bytes.Buffer
+	utils.WriteICal(&b, cal)
+	return b.String()
+}
+
+// davMultistatus builds a 207 body by hand, so that the namespaces are
+// declared once on the root with the prefixes clients expect.
+type davMultistatus struct {
+	b strings.Builder
+}
+
+func newMultistatus() *davMultistatus {
+	m := &davMultistatus{}
+	m.b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	m.b.WriteString(`<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/">`)
+	return m
+}
+
+// element writes <name>inner</name>, declaring the namespace inline if
+// it has no prefix.
+func (m *davMultistatus) element(name xml.Name, inner string) {
+	tag, decl := davPrefixes[name.Space]+":"+name.Local, ""
+	if _, ok := davPrefixes[name.Space]; !ok {
+		tag, decl = "X:"+name.Local, ` xmlns:X="`+davEscape(name.Space)+`"`
+	}
+	if inner == "" {
+		m.b.WriteString("<" + tag + decl + "/>")
+		return
+	}
+	m.b.WriteString("<" + tag + decl + ">" + inner + "</" + tag + ">")
+}
+
+// resource describes res with the requested properties; names nil means
+// all of them except calendar-data (allprop). With namesOnly the values
+// are left out (propname).
+func (m *davMultistatus) resource(res davResource, names []xml.Name, namesOnly bool) {
+	if names == nil {
+		for name := range res.props {
+			if name != davCalendarData || namesOnly {
+				names = append(names, name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool { return names[i].Local < names[j].Local })
+	}
+
+	found := &davMultistatus{}
+	var missing []xml.Name
+	for _, name := range names {
+		value, ok := res.props[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		inner := ""
+		if !namesOnly {
+			inner = value()
+		}
+		found.element(name, inner)
+	}
+
+	m.b.WriteString("<D:response><D:href>" + davEscape(res.href) + "</D:href>")
+	if found.b.Len() > 0 {
+		m.b.WriteString("<D:propstat><D:prop>" + found.b.String() + "</D:prop>" + davStatus(http.StatusOK) + "</D:propstat>")
+	}
+	if len(missing) > 0 {
+		m.b.WriteString("<D:propstat><D:prop>")
+		for _, name := range missing {
+			m.element(name, "")
+		}
+		m.b.WriteString("</D:prop>" + davStatus(http.StatusNotFound) + "</D:propstat>")
+	}
+	m.b.WriteString("</D:response>")
+}
+
+// status reports an href with no properties, such as a deleted task in
+// sync-collection or an unknown href in calendar-multiget.
+func (m *davMultistatus) status(href string, status int) {
+	m.b.WriteString("<D:response><D:href>" + davEscape(href) + "</D:href>" + davStatus(status) + "</D:response>")
+}
+
+func (m *davMultistatus) write(w http.ResponseWriter, syncToken string) {
+	if syncToken != "" {
+		m.b.WriteString("<D:sync-token>" + davEscape(syncToken) + "</D:sync-token>")
+	}
+	m.b.WriteString("</D:multistatus>\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, m.b.String())
+}
+
+func davStatus(status int) string {
+	return fmt.Sprintf("<D:status>HTTP/1.1 %d %s</D:status>", status, http.StatusText(status))
+}
+
+// davError writes a DAV precondition failure: <D:error><C:condition/></D:error>.
+func davError(w http.ResponseWriter, status int, condition xml.Name) {
+	m := &davMultistatus{}
+	m.element(condition, "")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+
+		`<D:error xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">`+m.b.String()+"</D:error>\n")
+}
+
+// davPropList is the <prop> of a PROPFIND or REPORT.
+type davPropList struct {
+	Names []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+func (l *davPropList) names() []xml.Name {
+	if l == nil || len(l.Names) == 0 {
+		return nil
+	}
+	names := make([]xml.Name, len(l.Names))
+	for i, n := range l.Names {
+		names[i] = n.XMLName
+	}
+	return names
+}
+
+// parsePropfind reads which properties a PROPFIND asks for: nil for all
+// of them (allprop, or no body), and whether only names are wanted.
+func parsePropfind(w http.ResponseWriter, r *http.Request) ([]xml.Name, bool, bool) {
+	var body struct {
+		PropName *struct{}   `xml:"DAV: propname"`
+		Prop     davPropList `xml:"DAV: prop"`
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		utils.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return nil, false, false
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, false, true
+	}
+	if err := xml.Unmarshal(data, &body); err != nil {
+		utils.Error(w, "Invalid PROPFIND body", http.StatusBadRequest)
+		return nil, false, false
+	}
+	return body.Prop.names(), body.PropName != nil, true
+}
+
+// davDepth is whether a PROPFIND should include the resource's members.
+// A missing Depth means infinity, which is answered as 1.
+func davDepth(r *http.Request) bool {
+	return r.Header.Get("Depth") != "0"
+}
+
+// davAccess checks the URL's user is the caller and the token has scope.
+func davAccess(w http.ResponseWriter, r *http.Request, scope string) bool {
+	if mux.Vars(r)["user"] != middlewares.GetUserID(r).String() {
+		utils.Error(w, "Not found", http.StatusNotFound)
+		return false
+	}
+	if !middlewares.HasScope(r, scope) {
+		utils.ErrorCode(w, "Token is missing the "+scope+" scope", http.StatusForbidden, "insufficient_scope")
+		return false
+	}
+	return true
+}
+
+func davOptions(w http.ResponseWriter, allow string) {
+	w.Header().Set("DAV", "1, 3, calendar-access")
+	w.Header().Set("Allow", allow)
+}
+
+func davMethodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	davOptions(w, allow)
+	utils.Error(w, r.Method+" is not allowed on "+r.URL.Path, http.StatusMethodNotAllowed)
+}
+
+// CalDAVWellKnown sends clients looking for /.well-known/caldav to the
+// root (RFC 6764).
+func CalDAVWellKnown(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/dav/", http.StatusMovedPermanently)
+}
+
+// CalDAVRoot answers discovery with the caller's principal.
+func CalDAVRoot(w http.ResponseWriter, r *http.Request) {
+	const allow = "OPTIONS, PROPFIND"
+	switch r.Method {
+	case http.MethodOptions:
+		davOptions(w, allow)
+	case "PROPFIND":
+		names, namesOnly, ok := parsePropfind(w, r)
+		if !ok {
+			return
+		}
+		m := newMultistatus()
+		m.resource(davRootResource(r), names, namesOnly)
+		m.write(w, "")
+	default:
+		davMethodNotAllowed(w, r, allow)
+	}
+}
+
+// CalDAVHome is the principal and calendar home; its one calendar is
+// the task collection.
+func CalDAVHome(w http.ResponseWriter, r *http.Request) {
+	const allow = "OPTIONS, PROPFIND"
+	if !davAccess(w, r, middlewares.ScopeTasksRead) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		davOptions(w, allow)
+	case "PROPFIND":
+		names, namesOnly, ok := parsePropfind(w, r)
+		if !ok {
+			return
+		}
+		m := newMultistatus()
+		m.resource(davHomeResource(r), names, namesOnly)
+		if davDepth(r) {
+			seq, _, err := currentSyncSeq(context.Background(), middlewares.GetUserID(r))
+			if err != nil {
+				utils.Error(w, "Failed to read calendar", http.StatusInternalServerError)
+				return
+			}
+			m.resource(davCollectionResource(r, seq), names, namesOnly)
+		}
+		m.write(w, "")
+	default:
+		davMethodNotAllowed(w, r, allow)
+	}
+}
+
+// CalDAVCollection is the task calendar: PROPFIND lists it (and its
+// tasks at Depth 1), REPORT runs calendar-query, calendar-multiget and
+// sync-collection.
+func CalDAVCollection(w http.ResponseWriter, r *http.Request) {
+	const allow = "OPTIONS, PROPFIND, REPORT"
+	if !davAccess(w, r, middlewares.ScopeTasksRead) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		davOptions(w, allow)
+	case "PROPFIND":
+		propfindDAVCollection(w, r)
+	case "REPORT":
+		reportDAVCollection(w, r)
+	default:
+		davMethodNotAllowed(w, r, allow)
+	}
+}
+
+func propfindDAVCollection(w http.ResponseWriter, r *http.Request) {
+	names, namesOnly, ok := parsePropfind(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := context.Background()
+	userID := middlewares.GetUserID(r)
+	seq, _, err := currentSyncSeq(ctx, userID)
+	if err != nil {
+		utils.Error(w, "Failed to read calendar", http.StatusInternalServerError)
+		return
+	}
+
+	m := newMultistatus()
+	m.resource(davCollectionResource(r, seq), names, namesOnly)
+	if davDepth(r) {
+		tasks, err := davTasks(ctx, db.Pool, userID, "deleted_at IS NULL")
+		if err != nil {
+			utils.Error(w, "Failed to read calendar", http.StatusInternalServerError)
+			return
+		}
+		for _, t := range tasks {
+			m.resource(davObjectResource(r, t), names, namesOnly)
+		}
+	}
+	m.write(w, "")
+}
+
+// davReport is the body of any of the supported REPORTs.
+type davReport struct {
+	XMLName   xml.Name
+	Prop      davPropList `xml:"DAV: prop"`
+	Hrefs     []string    `xml:"DAV: href"`
+	SyncToken string      `xml:"DAV: sync-token"`
+	Filter    *struct {
+		Comp *davCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	} `xml:"urn:ietf:params:xml:ns:caldav filter"`
+}
+
+type davCompFilter struct {
+	Name      string          `xml:"name,attr"`
+	Comps     []davCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	TimeRange *struct {
+		Start string `xml:"start,attr"`
+		End   string `xml:"end,attr"`
+	} `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+}
+
+// matches applies a calendar-query filter. It must select VTODOs inside
+// the VCALENDAR; a time-range on them is compared with the due date
+// (RFC 4791 9.9), and recurring or undated tasks always match. Other
+// filters are not applied, which can only return more than was asked.
+func (f *davCompFilter) matches(t davTask) bool {
+	if f == nil {
+		return true
+	}
+	if !strings.EqualFold(f.Name, "VCALENDAR") {
+		return false
+	}
+	if len(f.Comps) == 0 {
+		return true
+	}
+
+	for _, c := range f.Comps {
+		if !strings.EqualFold(c.Name, "VTODO") {
+			continue
+		}
+		if c.TimeRange == nil || t.DueAt == nil || t.Recurrence != "" {
+			return true
+		}
+		start, startErr := time.Parse("20060102T150405Z", c.TimeRange.Start)
+		end, endErr := time.Parse("20060102T150405Z", c.TimeRange.End)
+		if (startErr != nil || start.Before(*t.DueAt)) && (endErr != nil || !end.Before(*t.DueAt)) {
+			return true
+		}
+	}
+	return false
+}
+
+func reportDAVCollection(w http.ResponseWriter, r *http.Request) {
+	var report davReport
+	if err := xml.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&report); err != nil {
+		utils.Error(w, "Invalid REPORT body", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	userID := middlewares.GetUserID(r)
+	names := report.Prop.names()
+	m := newMultistatus()
+
+	switch report.XMLName {
+	case xml.Name{Space: nsCalDAV, Local: "calendar-query"}:
+		tasks, err := davTasks(ctx, db.Pool, userID, "deleted_at IS NULL")
+		if err != nil {
+			utils.Error(w, "Failed to read calendar", http.StatusInternalServerError)
+			return
+		}
+		var filter *davCompFilter
+		if report.Filter != nil {
+			filter = report.Filter.Comp
+		}
+		for _, t := range tasks {
+			if filter.matches(t) {
+				m.resource(davObjectResource(r, t), names, false)
+			}
+		}
+		m.write(w, "")
+
+	case xml.Name{Space: nsCalDAV, Local: "calendar-multiget"}:
+		hrefNames := map[string]string{}
+		taskNames := []string{}
+		for _, href := range report.Hrefs {
+			if u, err := url.Parse(strings.TrimSpace(href)); err == nil {
+				name := path.Base(u.Path)
+				hrefNames[href] = name
+				taskNames = append(taskNames, name)
+			}
+		}
+		tasks, err := davTasks(ctx, db.Pool, userID,
+			"deleted_at IS NULL AND COALESCE(dav_name, id::text || '.ics') = ANY($2)", taskNames)
+		if err != nil {
+			utils.Error(w, "Failed to read calendar", http.StatusInternalServerError)
+			return
+		}
+		byName := map[string]davTask{}
+		for _, t := range tasks {
+			byName[t.Name] = t
+		}
+		for _, href := range report.Hrefs {
+			if t, ok := byName[hrefNames[href]]; ok {
+				m.resource(davObjectResource(r, t), names, false)
+			} else {
+				m.status(href, http.StatusNotFound)
+			}
+		}
+		m.write(w, "")
+
+	case xml.Name{Space: nsDAV, Local: "sync-collection"}:
+		syncDAVCollection(w, r, report, m)
+
+	default:
+		davError(w, http.StatusForbidden, xml.Name{Space: nsDAV, Local: "supported-report"})
+	}
+}
+
+// syncDAVCollection reports what changed since the client's sync-token:
+// changed tasks with their properties and trashed ones as 404. Without a
+// token it lists every task.
+func syncDAVCollection(w http.ResponseWriter, r *http.Request, report davReport, m *davMultistatus) {
+	ctx := context.Background()
+	userID := middlewares.GetUserID(r)
+
+	seq, floor, err := currentSyncSeq(ctx, userID)
+	if err != nil {
+		utils.Error(w, "Failed to read calendar", http.StatusInternalServerError)
+		return
+	}
+
+	var tasks []davTask
+	if token := strings.TrimSpace(report.SyncToken); token == "" {
+		tasks, err = davTasks(ctx, db.Pool, userID, "deleted_at IS NULL")
+	} else {
+		since, ok := parseSyncToken(token)
+		if !ok || since < floor || since > seq {
+			davError(w, http.StatusForbidden, xml.Name{Space: nsDAV, Local: "valid-sync-token"})
+			return
+		}
+		tasks, err = davTasks(ctx, db.Pool, userID, "sync_seq > $2", since)
+	}
+	if err != nil {
+		utils.Error(w, "Failed to read calendar", http.StatusInternalServerError)
+		return
+	}
+
+	for _, t := range tasks {
+		if t.Trashed {
+			m.status(davObjectHref(userID, t.Name), http.StatusNotFound)
+		} else {
+			m.resource(davObjectResource(r, t), report.Prop.names(), false)
+		}
+	}
+	m.write(w, formatSyncToken(seq))
+}
+
+// CalDAVObject is one task as a calendar object resource.
+func CalDAVObject(w http.ResponseWriter, r *http.Request) {
+	const allow = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND"
+	switch r.Method {
+	case http.MethodOptions:
+		davOptions(w, allow)
+	case http.MethodGet, http.MethodHead:
+		if davAccess(w, r, middlewares.ScopeTasksRead) {
+			getDAVObject(w, r)
+		}
+	case "PROPFIND":
+		if davAccess(w, r, middlewares.ScopeTasksRead) {
+			propfindDAVObject(w, r)
+		}
+	case http.MethodPut:
+		if davAccess(w, r, middlewares.ScopeTasksWrite) {
+			middlewares.RequireVerified(putDAVObject)(w, r)
+		}
+	case http.MethodDelete:
+		if davAccess(w, r, middlewares.ScopeTasksWrite) {
+			deleteDAVObject(w, r)
+		}
+	default:
+		davMethodNotAllowed(w, r, allow)
+	}
+}
+
+func getDAVObject(w http.ResponseWriter, r *http.Request) {
+	t, err := davTaskByName(context.Background(), db.Pool, middlewares.GetUserID(r), mux.Vars(r)["name"], false)
+	if err != nil {
+		utils.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if notModified(w, r, t.ETag) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	io.WriteString(w, davCalendarObject(t))
+}
+
+func propfindDAVObject(w http.ResponseWriter, r *http.Request) {
+	names, namesOnly, ok := parsePropfind(w, r)
+	if !ok {
+		return
+	}
+	t, err := davTaskByName(context.Background(), db.Pool, middlewares.GetUserID(r), mux.Vars(r)["name"], false)
+	if err != nil {
+		utils.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	m := newMultistatus()
+	m.resource(davObjectResource(r, t), names, namesOnly)
+	m.write(w, "")
+}
+
+// davTodo picks the VTODO out of a PUT body: exactly one UID, and the
+// master component if the client sent overridden instances too.
+func davTodo(body io.Reader) (*utils.ICalComponent, xml.Name, error) {
+	invalid := xml.Name{Space: nsCalDAV, Local: "valid-calendar-data"}
+	calendars, err := utils.ParseICal(body)
+	if err != nil {
+		return nil, invalid, err
+	}
+
+	var todo *utils.ICalComponent
+	uid := ""
+	for _, cal := range calendars {
+		for _, c := range cal.Components {
+			switch c.Name {
+			case "VTIMEZONE":
+			case "VTODO":
+				if uid != "" && c.Text("UID") != uid {
+					return nil, xml.Name{Space: nsCalDAV, Local: "valid-calendar-object-resource"},
+						errors.New("a calendar object holds one UID")
+				}
+				uid = c.Text("UID")
+				if todo == nil || c.Prop("RECURRENCE-ID") == nil {
+					todo = c
+				}
+			default:
+				return nil, xml.Name{Space: nsCalDAV, Local: "supported-calendar-component"},
+					errors.New("only VTODO is supported")
+			}
+		}
+	}
+	if todo == nil || uid == "" {
+		return nil, xml.Name{Space: nsCalDAV, Local: "valid-calendar-object-resource"}, errors.New("no VTODO with a UID")
+	}
+	return todo, xml.Name{}, nil
+}
+
+// putDAVObject creates or replaces a task from a VTODO. The stored task
+// is not byte-for-byte what was sent, so no ETag is returned and the
+// client fetches it again (RFC 4791 5.3.4).
+func putDAVObject(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+	name := mux.Vars(r)["name"]
+
+	todo, condition, err := davTodo(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		davError(w, http.StatusForbidden, condition)
+		return
+	}
+	rec, errs := taskRecordFromICal(todo, userLocation(userID))
+	f := rec.taskFields
+	f.validate(errs)
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Failed to save task", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := davTaskByName(ctx, tx, userID, name, true)
+	exists := err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		utils.Error(w, "Failed to save task", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case exists && r.Header.Get("If-None-Match") == "*":
+		utils.ErrorCode(w, "Task already exists", http.StatusPreconditionFailed, "version_conflict")
+		return
+	case !exists && r.Header.Get("If-Match") != "":
+		utils.ErrorCode(w, "Task no longer exists", http.StatusPreconditionFailed, "version_conflict")
+		return
+	case exists && !checkIfMatch(w, r, before.ETag):
+		return
+	}
+
+	status := http.StatusNoContent
+	var task models.Task
+	if exists {
+		if f.ImageURL == "" {
+			f.ImageURL = before.ImageURL
+		}
+		task, err = saveTask(ctx, tx, userID, RevisionUpdated, before.Task, f)
+	} else {
+		var taken bool
+		err = tx.QueryRow(ctx,
+			`SELECT EXISTS (SELECT 1 FROM tasks WHERE user_id=$1 AND deleted_at IS NULL AND archived_at IS NULL
+			   AND COALESCE(external_id, id::text)=$2)`,
+			userID, rec.ExternalID,
+		).Scan(&taken)
+		if err == nil && taken {
+			davError(w, http.StatusForbidden, xml.Name{Space: nsCalDAV, Local: "no-uid-conflict"})
+			return
+		}
+
+		status = http.StatusCreated
+		err = scanTask(tx.QueryRow(ctx,
+			`INSERT INTO tasks (title, details, done, image_url, due_at, tags, recurrence, priority, user_id, external_id, dav_name)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			 RETURNING `+taskColumns,
+			f.Title, f.Details, f.Done, f.ImageURL, f.DueAt, f.Tags, f.Recurrence, f.Priority, userID, rec.ExternalID, name,
+		), &task)
+		if err == nil {
+			err = recordRevision(ctx, tx, userID, RevisionCreated, nil, task)
+		}
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		utils.Error(w, "Failed to save task", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
+// deleteDAVObject moves the task to the trash, like DELETE /tasks/{id}.
+func deleteDAVObject(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Delete failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := davTaskByName(ctx, tx, userID, mux.Vars(r)["name"], true)
+	if err != nil {
+		utils.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if !checkIfMatch(w, r, current.ETag) {
+		return
+	}
+
+	deleted, err := trashTask(ctx, tx, userID, current.Task)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		utils.Error(w, "Delete failed", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, userID, AuditTaskDeleted, "task", current.ID.String(), deleted, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+const icalProductID = "-//task-api//Tasks//EN"
+
+// CreateCalendarFeed godoc
+// @Summary      Get a calendar subscription URL
+// @Description  Returns a secret iCalendar URL for the caller's tasks with due dates. The URL is shown once; calling this again replaces it.
+// @Tags         calendar
+// @Produce      json
+// @Success      201 {object} map[string]string
+// @Router       /me/calendar-feed [post]
+func CreateCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	raw, hash, err := utils.GenerateToken()
+	if err != nil {
+		utils.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Pool.Exec(context.Background(), "UPDATE users SET calendar_token_hash=$1 WHERE id=$2", hash, userID)
+	if err != nil {
+		utils.Error(w, "Failed to create calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, userID, AuditTokenCreated, "calendar_feed", userID.String(), nil, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"url": appURL() + "/calendar/" + raw + ".ics"})
+}
+
+// DeleteCalendarFeed turns the subscription URL off.
+func DeleteCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	_, err := db.Pool.Exec(context.Background(), "UPDATE users SET calendar_token_hash=NULL WHERE id=$1", userID)
+	if err != nil {
+		utils.Error(w, "Failed to delete calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, userID, AuditTokenRevoked, "calendar_feed", userID.String(), nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetCalendarFeed godoc
+// @Summary      Calendar subscription
+// @Description  The tasks with due dates of the user the token belongs to, as VTODOs. Calendar apps that ignore VTODO can ask for components=VEVENT, an all-day or point-in-time event per task, or components=VTODO,VEVENT for both; apps that show both would list every task twice.
+// @Tags         calendar
+// @Produce      plain
+// @Param        token path string true "Feed token"
+// @Param        components query string false "VTODO (default), VEVENT or both, comma-separated"
+// @Success      200 {string} string "text/calendar"
+// @Failure      404 {object} utils.Problem "Unknown token"
+// @Router       /calendar/{token}.ics [get]
+func GetCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	todos, events := true, false
+	if components := r.URL.Query().Get("components"); components != "" {
+		todos, events = false, false
+		for _, name := range strings.Split(strings.ToUpper(components), ",") {
+			switch strings.TrimSpace(name) {
+			case "VTODO":
+				todos = true
+			case "VEVENT":
+				events = true
+			default:
+				utils.Error(w, "components must be VTODO, VEVENT or both", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	ctx := context.Background()
+	var userID uuid.UUID
+	err := db.Pool.QueryRow(ctx,
+		"SELECT id FROM users WHERE calendar_token_hash=$1 AND banned=false",
+		utils.HashToken(mux.Vars(r)["token"]),
+	).Scan(&userID)
+	if err != nil {
+		utils.Error(w, "Calendar feed not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Pool.Query(ctx,
+		"SELECT "+taskColumns+`, COALESCE(external_id, id::text)
+		 FROM tasks WHERE user_id=$1 AND due_at IS NOT NULL AND archived_at IS NULL AND deleted_at IS NULL ORDER BY due_at`,
+		userID)
+	if err != nil {
+		utils.Error(w, "Failed to fetch tasks", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tasks := []models.Task{}
+	records := []taskRecord{}
+	for rows.Next() {
+		var task models.Task
+		rec := taskRecord{}
+		if err := scanTask(rows, &task, &rec.ExternalID); err != nil {
+			utils.Error(w, "Failed to parse task", http.StatusInternalServerError)
+			return
+		}
+		rec.taskFields = fieldsOf(task)
+		tasks = append(tasks, task)
+		records = append(records, rec)
+	}
+
+	if notModified(w, r, tasksETag(tasks)) {
+		return
+	}
+
+	cal := taskCalendar()
+	cal.Add("REFRESH-INTERVAL", "PT1H", "VALUE", "DURATION")
+	cal.Add("X-PUBLISHED-TTL", "PT1H")
+	stamp := utils.ICalTime(time.Now())
+	for _, rec := range records {
+		if todos {
+			cal.Components = append(cal.Components, icalTodo(rec, stamp))
+		}
+		if events {
+			cal.Components = append(cal.Components, icalEvent(rec, stamp))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	utils.WriteICal(w, cal)
+}
+
+func taskCalendar() *utils.ICalComponent {
+	cal := &utils.ICalComponent{Name: "VCALENDAR"}
+	cal.Add("VERSION", "2.0")
+	cal.Add("PRODID", icalProductID)
+	cal.Add("CALSCALE", "GREGORIAN")
+	cal.Add("X-WR-CALNAME", "Tasks")
+	return cal
+}
+
+// addICalDate writes a due date at midnight UTC as a DATE, anything else
+// as a UTC DATE-TIME.
+func addICalDate(c *utils.ICalComponent, name string, t time.Time) {
+	if isDateOnly(t) {
+		c.Add(name, utils.ICalDate(t.UTC()), "VALUE", "DATE")
+	} else {
+		c.Add(name, utils.ICalTime(t))
+	}
+}
+
+// icalTodo is the task as a VTODO. Its UID is the record's external id,
+// so an exported task imported again is recognised.
+func icalTodo(rec taskRecord, stamp string) *utils.ICalComponent {
+	c := &utils.ICalComponent{Name: "VTODO"}
+	c.Add("UID", rec.ExternalID)
+	c.Add("DTSTAMP", stamp)
+	c.Add("SUMMARY", utils.ICalText(rec.Title))
+	if rec.Details != "" {
+		c.Add("DESCRIPTION", utils.ICalText(rec.Details))
+	}
+	if rec.DueAt != nil {
+		// A recurrence repeats from DTSTART
+		if rec.Recurrence != "" {
+			addICalDate(c, "DTSTART", *rec.DueAt)
+		}
+		addICalDate(c, "DUE", *rec.DueAt)
+	}
+	if rec.Recurrence != "" {
+		c.Add("RRULE", rec.Recurrence)
+	}
+	if rec.Done {
+		c.Add("STATUS", "COMPLETED")
+		c.Add("PERCENT-COMPLETE", "100")
+	} else {
+		c.Add("STATUS", "NEEDS-ACTION")
+	}
+	if priority := icalPriorities[rec.Priority]; priority != "" {
+		c.Add("PRIORITY", priority)
+	}
+	addICalCategories(c, rec.Tags)
+	if rec.ImageURL != "" {
+		c.Add("ATTACH", rec.ImageURL)
+	}
+	return c
+}
+
+// icalEvent is the task's due date as a VEVENT, for calendar apps that
+// ignore VTODO. Events have no completion state, so done tasks are
+// marked in the summary.
+func icalEvent(rec taskRecord, stamp string) *utils.ICalComponent {
+	c := &utils.ICalComponent{Name: "VEVENT"}
+	c.Add("UID", rec.ExternalID+"-due")
+	c.Add("DTSTAMP", stamp)
+	addICalDate(c, "DTSTART", *rec.DueAt)
+	if rec.Recurrence != "" {
+		c.Add("RRULE", rec.Recurrence)
+	}
+	summary := rec.Title
+	if rec.Done {
+		summary = "✓ " + summary
+	}
+	c.Add("SUMMARY", utils.ICalText(summary))
+	if rec.Details != "" {
+		c.Add("DESCRIPTION", utils.ICalText(rec.Details))
+	}
+	addICalCategories(c, rec.Tags)
+	c.Add("TRANSP", "TRANSPARENT")
+	return c
+}
+
+// icalPriorities are the RFC 5545 PRIORITY values tasks are written with;
+// 1 is the most urgent.
+var icalPriorities = map[string]string{priorityHigh: "1", priorityMedium: "5", priorityLow: "9"}
+
+// priorityFromICal reads PRIORITY the way RFC 5545 groups it: 1-4 high,
+// 5 medium, 6-9 low and 0 (or anything else) none.
+func priorityFromICal(value string) string {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	switch {
+	case err != nil || n < 1 || n > 9:
+		return ""
+	case n < 5:
+		return priorityHigh
+	case n == 5:
+		return priorityMedium
+	default:
+		return priorityLow
+	}
+}
+
+func addICalCategories(c *utils.ICalComponent, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	escaped := make([]string, len(tags))
+	for i, tag := range tags {
+		escaped[i] = utils.ICalText(tag)
+	}
+	c.Add("CATEGORIES", strings.Join(escaped, ","))
+}
+
+// parseICSImport reads the VTODOs of an .ics file; VEVENTs and other
+// components are ignored. Row is the VTODO's position in the file.
+func parseICSImport(body io.Reader, loc *time.Location) ([]importRecord, error) {
+	calendars, err := utils.ParseICal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []importRecord{}
+	for _, cal := range calendars {
+		for _, c := range cal.Components {
+			if c.Name != "VTODO" {
+				continue
+			}
+			if len(records) == maxImportRows {
+				return nil, errTooManyRows
+			}
+			rec, errs := taskRecordFromICal(c, loc)
+			records = append(records, importRecord{Row: len(records) + 1, Record: rec, Errors: errs})
+		}
+	}
+	return records, nil
+}
+
+// taskRecordFromICal maps a VTODO onto task fields, with its UID as the
+// external id. A missing DUE falls back to DTSTART and times without a
+// zone are read in loc. COMPLETED or STATUS:COMPLETED mark it done;
+// PRIORITY is grouped into high, medium and low; categories become
+// tags, with spaces turned into dashes.
+func taskRecordFromICal(c *utils.ICalComponent, loc *time.Location) (taskRecord, fieldErrors) {
+	errs := fieldErrors{}
+	rec := taskRecord{ExternalID: strings.TrimSpace(c.Text("UID"))}
+	rec.Title = c.Text("SUMMARY")
+	rec.Details = c.Text("DESCRIPTION")
+
+	due := c.Prop("DUE")
+	if due == nil {
+		due = c.Prop("DTSTART")
+	}
+	if due != nil {
+		t, err := utils.ParseICalTime(*due, loc)
+		if err != nil {
+			errs["due_at"] = "must be an iCalendar date or date-time"
+		} else {
+			rec.DueAt = &t
+		}
+	}
+
+	rec.Done = strings.EqualFold(c.Text("STATUS"), "COMPLETED") || c.Prop("COMPLETED") != nil
+	for _, p := range c.All("CATEGORIES") {
+		for _, category := range utils.ICalList(p.Value) {
+			if tag := strings.Join(strings.Fields(category), "-"); tag != "" {
+				rec.Tags = append(rec.Tags, tag)
+			}
+		}
+	}
+	if p := c.Prop("RRULE"); p != nil {
+		rec.Recurrence = p.Value
+	}
+	if p := c.Prop("PRIORITY"); p != nil {
+		rec.Priority = priorityFromICal(p.Value)
+	}
+	// Only an image already uploaded here is kept: anything else would
+	// be fetched from the server when the user exports their data
+	for _, p := range c.All("ATTACH") {
+		if isUploadedImageURL(p.Value) {
+			rec.ImageURL = p.Value
+			break
+		}
+	}
+	return rec, errs
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envDuration reads a Go duration ("15m", "48h") from the environment,
+// falling back to def when unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
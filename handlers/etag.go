@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"task-api/models"
+	"task-api/utils"
+)
+
+// requireIfMatch makes If-Match mandatory on task writes instead of
+// merely honoured when sent.
+func requireIfMatch() bool {
+	return os.Getenv("REQUIRE_IF_MATCH") == "true"
+}
+
+func taskETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// tasksETag identifies a whole list: it changes whenever a task is added,
+// removed or gets a new version.
+func tasksETag(tasks []models.Task) string {
+	h := sha256.New()
+	for _, t := range tasks {
+		fmt.Fprintf(h, "%s:%d\n", t.ID, t.Version)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagList splits an If-Match / If-None-Match header into its tags.
+func etagList(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// notModified handles If-None-Match for a read. It compares weakly, so
+// W/"x" matches "x". When it returns true a 304 has been written.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, tag := range etagList(header) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch handles If-Match for a write against the task's current
+// ETag. It compares strongly. On failure it writes 412 (or 428 when the
+// header is required but missing) and returns false.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, current string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if requireIfMatch() {
+			utils.ErrorCode(w, "If-Match header is required", http.StatusPreconditionRequired, "if_match_required")
+			return false
+		}
+		return true
+	}
+
+	for _, tag := range etagList(header) {
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+
+	w.Header().Set("ETag", current)
+	utils.ErrorCode(w, "Task has been modified since it was fetched", http.StatusPreconditionFailed, "version_conflict")
+	return false
+}
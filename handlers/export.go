@@ -0,0 +1,400 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+const downloadExportPurpose = "download_export"
+
+func exportDir() string {
+	if dir := os.Getenv("EXPORT_DIR"); dir != "" {
+		return dir
+	}
+	return "exports"
+}
+
+// exportTTL is how long a finished archive (and its link) is kept.
+func exportTTL() time.Duration {
+	return envDuration("EXPORT_TTL", 7*24*time.Hour)
+}
+
+// RequestMyExport queues an archive of the caller's own data.
+func RequestMyExport(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+	startExport(w, userID, userID)
+}
+
+// AdminExportUser exports any user's data; the link goes to the admin.
+func AdminExportUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	_ = db.Pool.QueryRow(context.Background(), "SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)", userID).Scan(&exists)
+	if !exists {
+		utils.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	audit(r, middlewares.GetUserID(r), AuditUserExported, "user", userID.String(), nil, nil)
+	startExport(w, userID, middlewares.GetUserID(r))
+}
+
+func startExport(w http.ResponseWriter, userID, requestedBy uuid.UUID) {
+	var export models.DataExport
+	err := db.Pool.QueryRow(context.Background(),
+		`INSERT INTO data_exports (user_id, requested_by)
+		 SELECT $1, $2
+		 WHERE NOT EXISTS (SELECT 1 FROM data_exports WHERE user_id=$1 AND requested_by=$2 AND status='pending')
+		 RETURNING id, user_id, status, created_at`,
+		userID, requestedBy,
+	).Scan(&export.ID, &export.UserID, &export.Status, &export.CreatedAt)
+	if err != nil {
+		utils.Error(w, "An export is already being prepared", http.StatusConflict)
+		return
+	}
+
+	go buildExport(export.ID, userID, requestedBy)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(export)
+}
+
+func GetMyExports(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id, user_id, status, created_at, completed_at, expires_at
+		 FROM data_exports WHERE requested_by=$1 ORDER BY created_at DESC`,
+		middlewares.GetUserID(r),
+	)
+	if err != nil {
+		utils.Error(w, "Failed to fetch exports", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	exports := []models.DataExport{}
+	for rows.Next() {
+		var e models.DataExport
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Status, &e.CreatedAt, &e.CompletedAt, &e.ExpiresAt); err != nil {
+			utils.Error(w, "Failed to parse export", http.StatusInternalServerError)
+			return
+		}
+		exports = append(exports, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(exports)
+}
+
+// DownloadExport is reached from the emailed link; the signed token is
+// the credential, so no login is needed.
+func DownloadExport(w http.ResponseWriter, r *http.Request) {
+	claims, err := parsePurposeToken(r.URL.Query().Get("token"), downloadExportPurpose)
+	if err != nil || claims["export_id"] != mux.Vars(r)["id"] {
+		utils.Error(w, "Invalid or expired download link", http.StatusForbidden)
+		return
+	}
+
+	var filePath string
+	err = db.Pool.QueryRow(context.Background(),
+		"SELECT file_path FROM data_exports WHERE id=$1 AND status='ready' AND expires_at > now()",
+		mux.Vars(r)["id"],
+	).Scan(&filePath)
+	if err != nil {
+		utils.Error(w, "Export not found or expired", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(filePath)+`"`)
+	http.ServeFile(w, r, filePath)
+}
+
+func buildExport(exportID, userID, requestedBy uuid.UUID) {
+	filePath := filepath.Join(exportDir(), exportID.String()+".zip")
+
+	err := writeExportArchive(filePath, userID)
+	if err != nil {
+		log.Printf("Export %s failed: %v", exportID, err)
+		os.Remove(filePath)
+		_, _ = db.Pool.Exec(context.Background(),
+			"UPDATE data_exports SET status='failed', completed_at=now() WHERE id=$1", exportID)
+		return
+	}
+
+	expiresAt := time.Now().Add(exportTTL())
+	commandTag, err := db.Pool.Exec(context.Background(),
+		"UPDATE data_exports SET status='ready', file_path=$1, completed_at=now(), expires_at=$2 WHERE id=$3",
+		filePath, expiresAt, exportID,
+	)
+	if err == nil && commandTag.RowsAffected() == 0 {
+		// The account was purged while the archive was being built
+		os.Remove(filePath)
+		return
+	}
+	if err != nil {
+		log.Printf("Export %s: %v", exportID, err)
+		return
+	}
+
+	token, err := signPurposeToken(downloadExportPurpose, jwt.MapClaims{
+		"export_id": exportID.String(),
+	}, exportTTL())
+	if err != nil {
+		log.Printf("Export %s: %v", exportID, err)
+		return
+	}
+
+	var email string
+	if err := db.Pool.QueryRow(context.Background(), "SELECT email FROM users WHERE id=$1", requestedBy).Scan(&email); err != nil {
+		return
+	}
+
+	link := fmt.Sprintf("%s/exports/%s/download?token=%s", appURL(), exportID, url.QueryEscape(token))
+	utils.SendEmail(email, "Your data export is ready", fmt.Sprintf(
+		"The data export you requested is ready. Download it before %s:\n\n%s",
+		expiresAt.Format(time.RFC1123), link,
+	))
+}
+
+func writeExportArchive(filePath string, userID uuid.UUID) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+
+	user, err := loadMe(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, "profile.json", user); err != nil {
+		return err
+	}
+
+	tasks, records, err := userTasks(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, "tasks.json", tasks); err != nil {
+		return err
+	}
+	if err := writeTasksCSV(zw, "tasks.csv", records); err != nil {
+		return err
+	}
+
+	// Task images live on Cloudinary, or under uploads/ for tasks that
+	// point at a local /upload; copy them in so the archive is complete
+	// on its own
+	for _, task := range tasks {
+		if task.ImageURL == "" {
+			continue
+		}
+		name := "files/" + task.ID.String() + path.Ext(task.ImageURL)
+		var err error
+		if strings.HasPrefix(task.ImageURL, "/uploads/") {
+			err = copyLocalFile(zw, name, filepath.Join("uploads", path.Base(task.ImageURL)))
+		} else {
+			err = copyRemoteFile(zw, name, task.ImageURL)
+		}
+		if err != nil {
+			log.Printf("Export: skipping image for task %s: %v", task.ID, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// userTasks is the user's tasks, and the same tasks as export records.
+func userTasks(userID uuid.UUID) ([]models.Task, []taskRecord, error) {
+	rows, err := db.Pool.Query(context.Background(),
+		"SELECT "+taskColumns+`, COALESCE(external_id, id::text)
+		 FROM tasks WHERE user_id=$1 AND deleted_at IS NULL ORDER BY id`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	tasks := []models.Task{}
+	records := []taskRecord{}
+	for rows.Next() {
+		var task models.Task
+		var rec taskRecord
+		if err := scanTask(rows, &task, &rec.ExternalID); err != nil {
+			return nil, nil, err
+		}
+		rec.taskFields = fieldsOf(task)
+		tasks = append(tasks, task)
+		records = append(records, rec)
+	}
+	return tasks, records, rows.Err()
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeTasksCSV writes the same CSV as GET /tasks/export?format=csv.
+func writeTasksCSV(zw *zip.Writer, name string, records []taskRecord) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(fw)
+	cw.Write(csvColumns)
+	for _, rec := range records {
+		cw.Write(csvRow(rec))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// maxExportImageBytes caps each image copied into an archive.
+const maxExportImageBytes = 20 << 20
+
+// imageClient fetches task images for exports. It only follows
+// redirects within the image host, goes direct rather than through a
+// proxy, and refuses to connect to private, loopback or link-local
+// addresses whatever DNS says.
+var imageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: refuseInternalAddress}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 || !isUploadedImageURL(req.URL.String()) {
+			return fmt.Errorf("refusing redirect to %s", req.URL.Redacted())
+		}
+		return nil
+	},
+}
+
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func refuseInternalAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || carrierGradeNAT.Contains(ip) {
+		return fmt.Errorf("refusing to connect to internal address %s", host)
+	}
+	return nil
+}
+
+// copyRemoteFile adds an uploaded task image to the archive. Anything
+// stored in image_url before it was limited to uploads is skipped.
+func copyRemoteFile(zw *zip.Writer, name, src string) error {
+	if !isUploadedImageURL(src) {
+		return fmt.Errorf("%s is not an uploaded image", src)
+	}
+
+	resp, err := imageClient.Get(src)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", src, resp.Status)
+	}
+
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, io.LimitReader(resp.Body, maxExportImageBytes))
+	return err
+}
+
+// copyLocalFile adds an image stored by POST /upload to the archive.
+func copyLocalFile(zw *zip.Writer, name, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, io.LimitReader(f, maxExportImageBytes))
+	return err
+}
+
+// PurgeExpiredExports removes archives whose download window has passed.
+func PurgeExpiredExports() error {
+	rows, err := db.Pool.Query(context.Background(),
+		"SELECT id, file_path FROM data_exports WHERE status='ready' AND expires_at < now()")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var expired []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		var filePath string
+		if err := rows.Scan(&id, &filePath); err != nil {
+			return err
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("PurgeExpiredExports: %v", err)
+			continue
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+
+	_, err = db.Pool.Exec(context.Background(),
+		"UPDATE data_exports SET status='expired', file_path=NULL WHERE id = ANY($1)", expired)
+	return err
+}
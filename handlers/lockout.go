@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"task-api/db"
+	"task-api/utils"
+)
+
+const (
+	unlockAccountPurpose = "unlock_account"
+	maxLoginBackoff      = 15 * time.Minute
+)
+
+// Failed logins are tracked per account and per client IP. Below the
+// backoff threshold attempts are free; past it each further failure
+// doubles the wait, and an account that reaches LOGIN_MAX_FAILURES is
+// locked outright until LOGIN_LOCKOUT_DURATION passes or the owner uses
+// the emailed unlock link.
+func loginBackoffThreshold() int {
+	return envInt("LOGIN_BACKOFF_THRESHOLD", 3)
+}
+
+func loginMaxFailures() int {
+	return envInt("LOGIN_MAX_FAILURES", 10)
+}
+
+func ipBackoffThreshold() int {
+	return envInt("LOGIN_IP_BACKOFF_THRESHOLD", 20)
+}
+
+func lockoutDuration() time.Duration {
+	return envDuration("LOGIN_LOCKOUT_DURATION", 30*time.Minute)
+}
+
+// ipFailureWindow is how long an IP's failures are remembered.
+func ipFailureWindow() time.Duration {
+	return envDuration("LOGIN_IP_FAILURE_WINDOW", 15*time.Minute)
+}
+
+func loginBackoff(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	d := time.Second << uint(min(failures-threshold, 20))
+	return min(d, maxLoginBackoff)
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	utils.ErrorCode(w, msg, http.StatusTooManyRequests, "rate_limited")
+}
+
+// ipRetryAfter reports how long the client IP must wait before trying
+// to log in again.
+func ipRetryAfter(ip string) time.Duration {
+	var failures int
+	var lastFailed time.Time
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT failures, last_failed_at FROM login_ip_failures WHERE ip=$1", ip,
+	).Scan(&failures, &lastFailed)
+	if err != nil || time.Since(lastFailed) > ipFailureWindow() {
+		return 0
+	}
+
+	return time.Until(lastFailed.Add(loginBackoff(failures, ipBackoffThreshold())))
+}
+
+func recordIPFailure(ip string) {
+	_, err := db.Pool.Exec(context.Background(),
+		`INSERT INTO login_ip_failures (ip, failures, last_failed_at) VALUES ($1, 1, now())
+		 ON CONFLICT (ip) DO UPDATE SET
+		   failures = CASE WHEN login_ip_failures.last_failed_at < $2 THEN 1 ELSE login_ip_failures.failures + 1 END,
+		   last_failed_at = now()`,
+		ip, time.Now().Add(-ipFailureWindow()),
+	)
+	if err != nil {
+		log.Printf("recordIPFailure error: %v", err)
+	}
+}
+
+// accountRetryAfter reports how long the account must wait, either
+// because it is locked or because of backoff from recent failures.
+func accountRetryAfter(userID uuid.UUID) (time.Duration, bool) {
+	var failures int
+	var lastFailed, lockedUntil *time.Time
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT failed_logins, last_failed_login_at, locked_until FROM users WHERE id=$1", userID,
+	).Scan(&failures, &lastFailed, &lockedUntil)
+	if err != nil {
+		return 0, false
+	}
+
+	if lockedUntil != nil && lockedUntil.After(time.Now()) {
+		return time.Until(*lockedUntil), true
+	}
+	if lastFailed != nil {
+		return time.Until(lastFailed.Add(loginBackoff(failures, loginBackoffThreshold()))), false
+	}
+	return 0, false
+}
+
+// recordLoginFailure bumps both counters and locks the account once it
+// reaches the limit, emailing the owner an unlock link. Taking the lock
+// starts the count again, so once it expires the account gets the full
+// number of attempts rather than being locked again by one more.
+func recordLoginFailure(userID uuid.UUID, ip string) {
+	recordIPFailure(ip)
+
+	var email string
+	var locked bool
+	err := db.Pool.QueryRow(context.Background(),
+		`UPDATE users u SET
+		   failed_logins = CASE WHEN u.failed_logins + 1 >= $2 THEN 0 ELSE u.failed_logins + 1 END,
+		   last_failed_login_at = now(),
+		   locked_until = CASE WHEN u.failed_logins + 1 >= $2 THEN $3 ELSE u.locked_until END
+		 WHERE u.id=$1
+		 RETURNING u.email, u.failed_logins = 0`,
+		userID, loginMaxFailures(), time.Now().Add(lockoutDuration()),
+	).Scan(&email, &locked)
+	if err != nil {
+		log.Printf("recordLoginFailure error: %v", err)
+		return
+	}
+
+	if locked {
+		if err := sendUnlockEmail(userID, email); err != nil {
+			log.Printf("sendUnlockEmail error: %v", err)
+		}
+	}
+}
+
+func resetLoginFailures(userID uuid.UUID) {
+	_, err := db.Pool.Exec(context.Background(),
+		"UPDATE users SET failed_logins=0, last_failed_login_at=NULL, locked_until=NULL WHERE id=$1 AND (failed_logins > 0 OR locked_until IS NOT NULL)",
+		userID,
+	)
+	if err != nil {
+		log.Printf("resetLoginFailures error: %v", err)
+	}
+}
+
+func sendUnlockEmail(userID uuid.UUID, email string) error {
+	token, err := signPurposeToken(unlockAccountPurpose, jwt.MapClaims{
+		"user_id": userID.String(),
+	}, 24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/unlock?token=%s", appURL(), url.QueryEscape(token))
+	go utils.SendEmail(email, "Your account has been locked", fmt.Sprintf(
+		"We locked your account after too many failed login attempts. It unlocks automatically in %s, or you can unlock it now:\n\n%s\n\nIf these attempts weren't you, consider resetting your password.",
+		lockoutDuration(), link,
+	))
+
+	return nil
+}
+
+func UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	claims, err := parsePurposeToken(r.URL.Query().Get("token"), unlockAccountPurpose)
+	if err != nil {
+		utils.Error(w, "Invalid or expired unlock link", http.StatusBadRequest)
+		return
+	}
+
+	userIDStr, _ := claims["user_id"].(string)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		utils.Error(w, "Invalid or expired unlock link", http.StatusBadRequest)
+		return
+	}
+
+	resetLoginFailures(userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account unlocked"})
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"task-api/db"
+	"task-api/models"
+	"task-api/utils"
+)
+
+func magicLinkTTL() time.Duration {
+	return envDuration("MAGIC_LINK_TTL", 15*time.Minute)
+}
+
+// RequestMagicLink emails a single-use login link. Like ForgotPassword it
+// always answers 202 so it can't be used to probe for accounts, and
+// sends at most one link per resendInterval.
+func RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email        string `json:"email"`
+		BindToDevice bool   `json:"bind_to_device"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+	bind := body.BindToDevice || os.Getenv("MAGIC_LINK_BIND_DEVICE") == "true"
+
+	var userID uuid.UUID
+	var banned bool
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT id, banned FROM users WHERE email=$1", email,
+	).Scan(&userID, &banned)
+
+	if err == nil && !banned {
+		if err := sendMagicLink(r, userID, email, bind); err != nil {
+			log.Printf("RequestMagicLink error: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If that email is registered, a login link has been sent",
+	})
+}
+
+// sendMagicLink stores the hash of a fresh token. When bind is set the
+// link only works from the same IP and user agent that requested it.
+func sendMagicLink(r *http.Request, userID uuid.UUID, email string, bind bool) error {
+	var recent bool
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM magic_link_tokens WHERE user_id=$1 AND created_at > $2)",
+		userID, time.Now().Add(-resendInterval()),
+	).Scan(&recent)
+	if err != nil || recent {
+		return err
+	}
+
+	raw, hash, err := utils.GenerateToken()
+	if err != nil {
+		return err
+	}
+
+	var ip, userAgent *string
+	if bind {
+		clientAddr, ua := clientIP(r), r.UserAgent()
+		ip, userAgent = &clientAddr, &ua
+	}
+
+	ttl := magicLinkTTL()
+	_, err = db.Pool.Exec(context.Background(),
+		`INSERT INTO magic_link_tokens (user_id, token_hash, expires_at, ip, user_agent)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		userID, hash, time.Now().Add(ttl), ip, userAgent,
+	)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/login/magic/callback?token=%s", appURL(), url.QueryEscape(raw))
+	go utils.SendEmail(email, "Your login link", fmt.Sprintf(
+		"Use this link to log in. It works once and expires in %s:\n\n%s\n\nIf you didn't ask for it, ignore this email.",
+		ttl, link,
+	))
+
+	return nil
+}
+
+// MagicLinkCallback exchanges a magic link token for the same response
+// Login returns.
+func MagicLinkCallback(w http.ResponseWriter, r *http.Request) {
+	raw := r.URL.Query().Get("token")
+	if raw == "" {
+		utils.Error(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+
+	// Consume first: a token presented from the wrong device is burned
+	// rather than left for another try
+	var userID uuid.UUID
+	var ip, userAgent *string
+	err := db.Pool.QueryRow(context.Background(),
+		`UPDATE magic_link_tokens SET used_at=now()
+		 WHERE token_hash=$1 AND used_at IS NULL AND expires_at > now()
+		 RETURNING user_id, ip, user_agent`,
+		utils.HashToken(raw),
+	).Scan(&userID, &ip, &userAgent)
+	if err != nil {
+		utils.Error(w, "Invalid or expired login link", http.StatusUnauthorized)
+		return
+	}
+
+	if (ip != nil && *ip != clientIP(r)) || (userAgent != nil && *userAgent != r.UserAgent()) {
+		utils.Error(w, "This login link must be opened on the device that requested it", http.StatusUnauthorized)
+		return
+	}
+
+	var user models.User
+	err = db.Pool.QueryRow(context.Background(),
+		"SELECT id, role, banned, totp_enabled FROM users WHERE id=$1", userID,
+	).Scan(&user.ID, &user.Role, &user.Banned, &user.TOTPEnabled)
+	if err != nil {
+		utils.Error(w, "Invalid or expired login link", http.StatusUnauthorized)
+		return
+	}
+
+	if user.Banned {
+		writeBanned(w, user.ID)
+		return
+	}
+
+	// Receiving the link proves the user owns the address
+	_, _ = db.Pool.Exec(context.Background(),
+		"UPDATE users SET email_verified=TRUE WHERE id=$1 AND NOT email_verified", user.ID)
+
+	// The link replaces the password, not the second factor
+	if user.TOTPEnabled {
+		mfaChallenge(w, user)
+		return
+	}
+
+	resetLoginFailures(user.ID)
+	issueToken(w, r, user, false)
+}
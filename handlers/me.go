@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/language"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+// deletionGracePeriod is how long a self-deleted account can still be
+// recovered before it is purged.
+func deletionGracePeriod() time.Duration {
+	return envDuration("ACCOUNT_DELETION_GRACE", 14*24*time.Hour)
+}
+
+// sessionIdleTimeout matches the JWT lifetime: a session not seen for
+// this long has no valid token left.
+const sessionIdleTimeout = 24 * time.Hour
+
+// recentLoginWindow is how recently an account without a password (one
+// made through OIDC) must have logged in to change its email or set a
+// password.
+const recentLoginWindow = 10 * time.Minute
+
+// reauthenticated is whether the request proves it comes from the
+// account's owner: the current password or, for an account that has
+// none, a session that logged in within recentLoginWindow. Refreshing a
+// token keeps the session, so only a real login counts.
+func reauthenticated(r *http.Request, userID uuid.UUID, currentPassword string) bool {
+	var password string
+	var loggedInAt *time.Time
+	err := db.Pool.QueryRow(context.Background(),
+		`SELECT u.password, s.created_at FROM users u
+		 LEFT JOIN sessions s ON s.id=$2 AND s.user_id=u.id AND s.revoked_at IS NULL
+		 WHERE u.id=$1`, userID, middlewares.GetSessionID(r),
+	).Scan(&password, &loggedInAt)
+	if err != nil {
+		return false
+	}
+	if password == "" {
+		return loggedInAt != nil && time.Since(*loggedInAt) < recentLoginWindow
+	}
+	return bcrypt.CompareHashAndPassword([]byte(password), []byte(currentPassword)) == nil
+}
+
+func loadMe(userID uuid.UUID) (models.User, error) {
+	var user models.User
+	err := db.Pool.QueryRow(context.Background(),
+		`SELECT id, name, email, role, banned, email_verified, pending_email, totp_enabled, timezone, locale, deletion_scheduled_at
+		 FROM users WHERE id=$1`, userID,
+	).Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.Banned, &user.EmailVerified, &user.PendingEmail,
+		&user.TOTPEnabled, &user.Timezone, &user.Locale, &user.DeletionScheduledAt)
+	return user, err
+}
+
+// userLocation is the user's timezone, for reading times that carry no
+// zone of their own. It falls back to UTC.
+func userLocation(userID uuid.UUID) *time.Location {
+	var timezone string
+	err := db.Pool.QueryRow(context.Background(), "SELECT timezone FROM users WHERE id=$1", userID).Scan(&timezone)
+	if err != nil {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func GetMe(w http.ResponseWriter, r *http.Request) {
+	user, err := loadMe(middlewares.GetUserID(r))
+	if err != nil {
+		utils.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// UpdateMe changes only the fields present in the body. A new email
+// address needs the current password and is only pending until the
+// link sent to it is opened; the old address keeps working until then.
+func UpdateMe(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	var body struct {
+		Name            *string `json:"name"`
+		Email           *string `json:"email"`
+		CurrentPassword string  `json:"current_password"`
+		Timezone        *string `json:"timezone"`
+		Locale          *string `json:"locale"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := loadMe(userID)
+	if err != nil {
+		utils.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	emailChanged := false
+
+	if body.Name != nil {
+		user.Name = strings.TrimSpace(*body.Name)
+		if user.Name == "" {
+			utils.Error(w, "Name cannot be empty", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if body.Email != nil {
+		email, err := utils.NormalizeEmail(*body.Email)
+		if err != nil {
+			utils.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case email == user.Email:
+			// Asking for the current address again cancels a pending change
+			user.PendingEmail = nil
+		case user.PendingEmail == nil || *user.PendingEmail != email:
+			if !reauthenticated(r, userID, body.CurrentPassword) {
+				utils.ErrorCode(w, "current_password is required to change your email; without a password, log in again first",
+					http.StatusForbidden, "current_password_required")
+				return
+			}
+
+			var taken bool
+			err := db.Pool.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM users WHERE email=$1)", email).Scan(&taken)
+			if err != nil {
+				utils.Error(w, "Failed to update profile", http.StatusInternalServerError)
+				return
+			}
+			if taken {
+				utils.ErrorCode(w, "Email already registered", http.StatusConflict, "email_taken")
+				return
+			}
+
+			user.PendingEmail = &email
+			emailChanged = true
+		}
+	}
+
+	if body.Timezone != nil {
+		if _, err := time.LoadLocation(*body.Timezone); err != nil || *body.Timezone == "" || *body.Timezone == "Local" {
+			utils.Error(w, "Unknown timezone", http.StatusBadRequest)
+			return
+		}
+		user.Timezone = *body.Timezone
+	}
+
+	if body.Locale != nil {
+		tag, err := language.Parse(*body.Locale)
+		if err != nil {
+			utils.Error(w, "Invalid locale", http.StatusBadRequest)
+			return
+		}
+		user.Locale = tag.String()
+	}
+
+	_, err = db.Pool.Exec(context.Background(),
+		"UPDATE users SET name=$1, pending_email=$2, timezone=$3, locale=$4 WHERE id=$5",
+		user.Name, user.PendingEmail, user.Timezone, user.Locale, userID,
+	)
+	if err != nil {
+		utils.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+
+	if emailChanged {
+		if err := sendEmailChangeLink(userID, *user.PendingEmail); err != nil {
+			log.Printf("UpdateMe verification email error: %v", err)
+		}
+		go utils.SendEmail(user.Email, "Email change requested",
+			fmt.Sprintf("Someone asked to change the email on your account to %s. Nothing changes until the link sent there is opened. "+
+				"If this wasn't you, change your password and sign out your other sessions.", *user.PendingEmail))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// ChangeMyPassword requires the current password, or a recent login for
+// an account that has none yet, and logs out every other session.
+func ChangeMyPassword(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(body.NewPassword) < minPasswordLength {
+		utils.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	if !reauthenticated(r, userID, body.CurrentPassword) {
+		utils.Error(w, "Current password is incorrect; to set a first password, log in again first",
+			http.StatusForbidden)
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), 14)
+	if err != nil {
+		utils.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Pool.Exec(context.Background(), "UPDATE users SET password=$1 WHERE id=$2", string(hashed), userID)
+	if err != nil {
+		utils.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Pool.Exec(context.Background(),
+		"UPDATE sessions SET revoked_at=now() WHERE user_id=$1 AND id<>$2 AND revoked_at IS NULL",
+		userID, middlewares.GetSessionID(r),
+	)
+	if err != nil {
+		log.Printf("ChangeMyPassword session revoke error: %v", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteMe schedules the account for deletion after the grace period.
+// Nothing is removed until PurgeDeletedAccounts runs.
+func DeleteMe(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+	purgeAt := time.Now().Add(deletionGracePeriod())
+
+	var email string
+	err := db.Pool.QueryRow(context.Background(),
+		`UPDATE users SET deletion_scheduled_at=$1
+		 WHERE id=$2 AND deletion_scheduled_at IS NULL RETURNING email`,
+		purgeAt, userID,
+	).Scan(&email)
+	if err != nil {
+		utils.Error(w, "Account deletion already scheduled", http.StatusConflict)
+		return
+	}
+
+	go utils.SendEmail(email, "Your account will be deleted", fmt.Sprintf(
+		"Your account and all of its tasks will be permanently deleted on %s. Log in and cancel the deletion before then if you change your mind.",
+		purgeAt.Format(time.RFC1123),
+	))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]time.Time{"deletion_scheduled_at": purgeAt})
+}
+
+func CancelDeleteMe(w http.ResponseWriter, r *http.Request) {
+	commandTag, err := db.Pool.Exec(context.Background(),
+		"UPDATE users SET deletion_scheduled_at=NULL WHERE id=$1 AND deletion_scheduled_at IS NOT NULL",
+		middlewares.GetUserID(r),
+	)
+	if err != nil || commandTag.RowsAffected() == 0 {
+		utils.Error(w, "No deletion scheduled", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeDeletedAccounts hard-deletes accounts whose grace period is over.
+// It runs on a schedule from main.
+func PurgeDeletedAccounts() error {
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		"DELETE FROM tasks WHERE user_id IN (SELECT id FROM users WHERE deletion_scheduled_at < now())")
+	if err != nil {
+		return err
+	}
+
+	// The data_exports rows go with the user; the archives on disk have
+	// to be removed first or nothing would ever find them again
+	rows, err := tx.Query(ctx,
+		`SELECT file_path FROM data_exports
+		 WHERE file_path IS NOT NULL
+		   AND (user_id IN (SELECT id FROM users WHERE deletion_scheduled_at < now())
+		     OR requested_by IN (SELECT id FROM users WHERE deletion_scheduled_at < now()))`)
+	if err != nil {
+		return err
+	}
+	paths, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	for _, filePath := range paths {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	commandTag, err := tx.Exec(ctx, "DELETE FROM users WHERE deletion_scheduled_at < now()")
+	if err != nil {
+		return err
+	}
+
+	if n := commandTag.RowsAffected(); n > 0 {
+		log.Printf("Purged %d deleted accounts", n)
+	}
+	return tx.Commit(ctx)
+}
+
+func GetMySessions(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id, COALESCE(ip, ''), COALESCE(user_agent, ''), mfa, created_at, last_seen_at
+		 FROM sessions
+		 WHERE user_id=$1 AND revoked_at IS NULL AND last_seen_at > $2
+		 ORDER BY last_seen_at DESC`,
+		middlewares.GetUserID(r), time.Now().Add(-sessionIdleTimeout),
+	)
+	if err != nil {
+		utils.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	current := middlewares.GetSessionID(r)
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		if err := rows.Scan(&s.ID, &s.IP, &s.UserAgent, &s.MFA, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			utils.Error(w, "Failed to parse session", http.StatusInternalServerError)
+			return
+		}
+		s.Current = s.ID == current
+		sessions = append(sessions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func RevokeMySession(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	commandTag, err := db.Pool.Exec(context.Background(),
+		"UPDATE sessions SET revoked_at=now() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL",
+		id, middlewares.GetUserID(r),
+	)
+	if err != nil || commandTag.RowsAffected() == 0 {
+		utils.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+const (
+	oidcStatePurpose = "oidc_state"
+	oidcStateCookie  = "oidc_state"
+	oidcStateTTL     = 10 * time.Minute
+)
+
+var (
+	oidcOnce     sync.Once
+	oidcProvider *utils.OIDCProvider
+)
+
+// getOIDCProvider returns nil when OIDC_ISSUER isn't set. The issuer can
+// be any OpenID provider, including a mock running on localhost.
+func getOIDCProvider() *utils.OIDCProvider {
+	oidcOnce.Do(func() {
+		issuer := os.Getenv("OIDC_ISSUER")
+		if issuer == "" {
+			return
+		}
+
+		redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+		if redirectURL == "" {
+			redirectURL = appURL() + "/login/oidc/callback"
+		}
+
+		oidcProvider = utils.NewOIDCProvider(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), redirectURL)
+	})
+	return oidcProvider
+}
+
+// OIDCLogin redirects to the identity provider. State, nonce and the PKCE
+// verifier travel in a signed, HttpOnly cookie so the callback can only
+// be completed by the browser that started the flow.
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider := getOIDCProvider()
+	if provider == nil {
+		utils.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+
+	state, _, err1 := utils.GenerateToken()
+	nonce, _, err2 := utils.GenerateToken()
+	verifier, challenge, err3 := utils.NewPKCEVerifier()
+	if err1 != nil || err2 != nil || err3 != nil {
+		utils.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		log.Printf("OIDC discovery error: %v", err)
+		utils.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	cookie, err := signPurposeToken(oidcStatePurpose, jwt.MapClaims{
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+	}, oidcStateTTL)
+	if err != nil {
+		utils.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    cookie,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(appURL(), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider := getOIDCProvider()
+	if provider == nil {
+		utils.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		utils.Error(w, "Login was not completed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		utils.Error(w, "Login session expired, please start again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/login/oidc", MaxAge: -1})
+
+	saved, err := parsePurposeToken(cookie.Value, oidcStatePurpose)
+	if err != nil || saved["state"] != r.URL.Query().Get("state") {
+		utils.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	nonce, _ := saved["nonce"].(string)
+	verifier, _ := saved["verifier"].(string)
+
+	claims, err := provider.Exchange(r.Context(), r.URL.Query().Get("code"), verifier, nonce)
+	if err != nil {
+		log.Printf("OIDC exchange error: %v", err)
+		utils.Error(w, "Could not verify identity provider response", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := findOrProvisionOIDCUser(provider.Issuer, claims)
+	if errors.Is(err, errOIDCUnverifiedEmail) {
+		utils.Error(w, "An account with this email already exists; the identity provider must verify the email before it can be linked", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("OIDC provisioning error: %v", err)
+		utils.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+
+	if user.Banned {
+		writeBanned(w, user.ID)
+		return
+	}
+
+	// The identity provider stands in for the password only: lockout,
+	// the unverified-email policy and the second factor still apply
+	if wait, locked := accountRetryAfter(user.ID); wait > 0 {
+		msg := "Too many failed login attempts, try again later"
+		if locked {
+			msg = "Account temporarily locked after too many failed login attempts"
+		}
+		tooManyRequests(w, wait, msg)
+		return
+	}
+
+	if !user.EmailVerified && middlewares.UnverifiedPolicy() == middlewares.UnverifiedBlock {
+		utils.ErrorCode(w, "Please verify your email address before logging in", http.StatusForbidden, "email_unverified")
+		return
+	}
+
+	if user.TOTPEnabled {
+		mfaChallenge(w, user)
+		return
+	}
+
+	resetLoginFailures(user.ID)
+	issueToken(w, r, user, false)
+}
+
+var errOIDCUnverifiedEmail = errors.New("email not verified by identity provider")
+
+// resetUnverifiedAccount strips every credential from an account whose
+// email was never verified before the address's owner links it: whoever
+// signed up may not own the address, and must not keep a way in.
+func resetUnverifiedAccount(ctx context.Context, tx pgx.Tx, userID uuid.UUID) error {
+	statements := []string{
+		`UPDATE users SET password='', email_verified=TRUE, totp_enabled=FALSE, totp_secret=NULL, totp_last_step=0,
+		   calendar_token_hash=NULL
+		 WHERE id=$1`,
+		"DELETE FROM mfa_recovery_codes WHERE user_id=$1",
+		"DELETE FROM webauthn_credentials WHERE user_id=$1",
+		"UPDATE personal_access_tokens SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(ctx, statement, userID); err != nil {
+			return err
+		}
+	}
+	return revokeSessions(ctx, tx, userID)
+}
+
+// findOrProvisionOIDCUser resolves the identity in order: an existing
+// link, an existing account with the same (provider-verified) email,
+// or a brand new account. An existing account that never verified its
+// email loses its credentials when linked.
+func findOrProvisionOIDCUser(issuer string, claims *utils.OIDCClaims) (models.User, error) {
+	ctx := context.Background()
+	var user models.User
+
+	err := db.Pool.QueryRow(ctx,
+		`SELECT u.id, u.role, u.banned, u.email_verified, u.totp_enabled FROM user_identities i
+		 JOIN users u ON u.id = i.user_id
+		 WHERE i.issuer=$1 AND i.subject=$2`,
+		issuer, claims.Subject,
+	).Scan(&user.ID, &user.Role, &user.Banned, &user.EmailVerified, &user.TOTPEnabled)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return user, err
+	}
+
+	email, err := utils.NormalizeEmail(claims.Email)
+	if err != nil {
+		return user, err
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx,
+		"SELECT id, role, banned, email_verified, totp_enabled FROM users WHERE email=$1", email,
+	).Scan(&user.ID, &user.Role, &user.Banned, &user.EmailVerified, &user.TOTPEnabled)
+
+	switch {
+	case err == nil:
+		// Linking by email is only safe if the provider vouches for it
+		if !claims.EmailVerified {
+			return user, errOIDCUnverifiedEmail
+		}
+		if !user.EmailVerified {
+			if err := resetUnverifiedAccount(ctx, tx, user.ID); err != nil {
+				return user, err
+			}
+			user.EmailVerified, user.TOTPEnabled = true, false
+		}
+	case errors.Is(err, pgx.ErrNoRows):
+		name := strings.TrimSpace(claims.Name)
+		if name == "" {
+			name = email[:strings.Index(email, "@")]
+		}
+
+		// No usable password: bcrypt never matches an empty hash
+		err = tx.QueryRow(ctx,
+			`INSERT INTO users (name, email, password, email_verified) VALUES ($1, $2, '', $3)
+			 RETURNING id, role, banned, email_verified, totp_enabled`,
+			name, email, claims.EmailVerified,
+		).Scan(&user.ID, &user.Role, &user.Banned, &user.EmailVerified, &user.TOTPEnabled)
+		if err != nil {
+			return user, err
+		}
+	default:
+		return user, err
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO user_identities (user_id, issuer, subject, email) VALUES ($1, $2, $3, $4)",
+		user.ID, issuer, claims.Subject, email,
+	)
+	if err != nil {
+		return user, err
+	}
+
+	return user, tx.Commit(ctx)
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"task-api/db"
+	"task-api/utils"
+)
+
+const minPasswordLength = 8
+
+// resetTokenTTL is how long an emailed reset link stays valid.
+// Override with PASSWORD_RESET_TTL (e.g. "30m").
+func resetTokenTTL() time.Duration {
+	return envDuration("PASSWORD_RESET_TTL", time.Hour)
+}
+
+// appURL is the public base URL used to build links in emails.
+func appURL() string {
+	if u := os.Getenv("APP_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// ForgotPassword always answers 202 so callers can't tell whether an
+// email is registered. Like verification emails, at most one link goes
+// out per resendInterval; requests in between are dropped silently.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+
+	var userID uuid.UUID
+	var banned bool
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT id, banned FROM users WHERE email=$1", email,
+	).Scan(&userID, &banned)
+
+	if err == nil && !banned {
+		if err := sendPasswordReset(userID, email); err != nil {
+			log.Printf("ForgotPassword error: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If that email is registered, a reset link has been sent",
+	})
+}
+
+func sendPasswordReset(userID uuid.UUID, email string) error {
+	var recent bool
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM password_reset_tokens WHERE user_id=$1 AND created_at > $2)",
+		userID, time.Now().Add(-resendInterval()),
+	).Scan(&recent)
+	if err != nil || recent {
+		return err
+	}
+
+	raw, hash, err := utils.GenerateToken()
+	if err != nil {
+		return err
+	}
+
+	// Only the most recent link should work
+	_, err = db.Pool.Exec(context.Background(),
+		"UPDATE password_reset_tokens SET used_at=now() WHERE user_id=$1 AND used_at IS NULL", userID)
+	if err != nil {
+		return err
+	}
+
+	ttl := resetTokenTTL()
+	_, err = db.Pool.Exec(context.Background(),
+		"INSERT INTO password_reset_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		userID, hash, time.Now().Add(ttl),
+	)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", appURL(), raw)
+	go utils.SendEmail(email, "Reset your password", fmt.Sprintf(
+		"Someone asked to reset your password. Use the link below within %s:\n\n%s\n\nIf this wasn't you, ignore this email.",
+		ttl, link,
+	))
+
+	return nil
+}
+
+// ResetPassword consumes a reset token, sets the new password and logs
+// the user out of every existing session.
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if body.Token == "" {
+		utils.Error(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+	if len(body.Password) < minPasswordLength {
+		utils.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(body.Password), 14)
+	if err != nil {
+		utils.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Password reset failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Marking the token used in the same statement makes it single-use
+	var userID uuid.UUID
+	err = tx.QueryRow(ctx,
+		`UPDATE password_reset_tokens SET used_at=now()
+		 WHERE token_hash=$1 AND used_at IS NULL AND expires_at > now()
+		 RETURNING user_id`,
+		utils.HashToken(body.Token),
+	).Scan(&userID)
+	if err != nil {
+		utils.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE users SET password=$1 WHERE id=$2", string(hashed), userID); err != nil {
+		utils.Error(w, "Password reset failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeSessions(ctx, tx, userID); err != nil {
+		utils.Error(w, "Password reset failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		utils.Error(w, "Password reset failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
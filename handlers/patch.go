@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/utils"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// PatchTask changes individual fields of a task. The body is either an
+// RFC 7396 merge patch or an RFC 6902 JSON Patch, chosen by Content-Type.
+func PatchTask(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid Task ID", http.StatusBadRequest)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != jsonPatchType {
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		utils.Error(w, "Content-Type must be "+mergePatchType+" or "+jsonPatchType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	patch, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Failed to update task", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := lockTask(ctx, tx, id)
+	if err != nil {
+		utils.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	userID := middlewares.GetUserID(r)
+	if middlewares.GetUserRole(r) != "admin" && before.UserID != userID {
+		utils.Error(w, "Not authorized to update this task", http.StatusForbidden)
+		return
+	}
+
+	if !checkIfMatch(w, r, before.ETag) {
+		return
+	}
+
+	// Patch paths are the task's JSON names; only taskFields can change
+	doc, err := json.Marshal(fieldsOf(before))
+	if err != nil {
+		utils.Error(w, "Failed to update task", http.StatusInternalServerError)
+		return
+	}
+
+	if mediaType == mergePatchType {
+		doc, err = utils.MergePatch(doc, patch)
+	} else {
+		doc, err = utils.ApplyJSONPatch(doc, patch)
+	}
+	if errors.Is(err, utils.ErrPatchTestFailed) {
+		utils.ErrorCode(w, err.Error(), http.StatusConflict, "patch_test_failed")
+		return
+	}
+	if err != nil {
+		utils.Error(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	patched, errs, err := decodeTaskJSON(bytes.NewReader(doc))
+	if err != nil {
+		utils.Error(w, "Invalid patch", http.StatusBadRequest)
+		return
+	}
+	patched.validateOver(before.ImageURL, errs)
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	task, err := saveTask(ctx, tx, userID, RevisionUpdated, before, patched)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		utils.Error(w, "Failed to update task", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", task.ETag)
+	json.NewEncoder(w).Encode(task)
+}
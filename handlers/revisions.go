@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+// Revision actions
+const (
+	RevisionCreated  = "created"
+	RevisionUpdated  = "updated"
+	RevisionDeleted  = "deleted"
+	RevisionRestored = "restored"
+	RevisionReverted = "reverted"
+)
+
+// Fields that are bookkeeping rather than content; they never show up
+// as changes.
+var revisionIgnoredFields = map[string]bool{
+	"id": true, "user_id": true, "deleted_at": true, "version": true, "etag": true,
+}
+
+// taskChanges diffs two versions of a task field by field, using the
+// JSON names clients see. before is nil for a newly created task.
+func taskChanges(before *models.Task, after models.Task) (map[string]models.FieldChange, error) {
+	oldFields := map[string]interface{}{}
+	if before != nil {
+		if err := roundTripJSON(before, &oldFields); err != nil {
+			return nil, err
+		}
+	}
+	newFields := map[string]interface{}{}
+	if err := roundTripJSON(after, &newFields); err != nil {
+		return nil, err
+	}
+
+	changes := map[string]models.FieldChange{}
+	for name, value := range newFields {
+		if revisionIgnoredFields[name] {
+			continue
+		}
+		if old, ok := oldFields[name]; !ok || !reflect.DeepEqual(old, value) {
+			changes[name] = models.FieldChange{Old: oldFields[name], New: value}
+		}
+	}
+	for name, old := range oldFields {
+		if _, ok := newFields[name]; !ok && !revisionIgnoredFields[name] {
+			changes[name] = models.FieldChange{Old: old, New: nil}
+		}
+	}
+	return changes, nil
+}
+
+func roundTripJSON(v, out interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// recordRevision appends the next revision of a task. Call it in the
+// same transaction as the change. An update that changed nothing is
+// not recorded.
+func recordRevision(ctx context.Context, q db.Querier, actorID uuid.UUID, action string, before *models.Task, after models.Task) error {
+	changes, err := taskChanges(before, after)
+	if err != nil {
+		return err
+	}
+	if action == RevisionUpdated && len(changes) == 0 {
+		return nil
+	}
+
+	var actor *uuid.UUID
+	if actorID != uuid.Nil {
+		actor = &actorID
+	}
+
+	_, err = q.Exec(ctx,
+		`INSERT INTO task_revisions (task_id, revision, action, actor_id, changes, snapshot)
+		 SELECT $1::uuid, COALESCE(MAX(revision), 0) + 1, $2::text, $3::uuid, $4::jsonb, $5::jsonb
+		 FROM task_revisions WHERE task_id=$1`,
+		after.ID, action, actor, changes, after,
+	)
+	return err
+}
+
+// canSeeTask reports whether the caller owns the task or is an admin.
+func canSeeTask(r *http.Request, taskID uuid.UUID) bool {
+	if middlewares.GetUserRole(r) == "admin" {
+		return true
+	}
+	var ownerID uuid.UUID
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT user_id FROM tasks WHERE id=$1 AND archived_at IS NULL", taskID,
+	).Scan(&ownerID)
+	return err == nil && ownerID == middlewares.GetUserID(r)
+}
+
+// GetTaskHistory lists a task's revisions, newest first.
+func GetTaskHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid Task ID", http.StatusBadRequest)
+		return
+	}
+
+	if !canSeeTask(r, id) {
+		utils.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT id, task_id, revision, action, actor_id, created_at, changes, snapshot
+		 FROM task_revisions WHERE task_id=$1 ORDER BY revision DESC`, id)
+	if err != nil {
+		utils.Error(w, "Failed to fetch task history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	revisions := []models.TaskRevision{}
+	for rows.Next() {
+		var rev models.TaskRevision
+		err := rows.Scan(&rev.ID, &rev.TaskID, &rev.Revision, &rev.Action, &rev.ActorID, &rev.CreatedAt, &rev.Changes, &rev.Snapshot)
+		if err != nil {
+			utils.Error(w, "Failed to parse task revision", http.StatusInternalServerError)
+			return
+		}
+		revisions = append(revisions, rev)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// RevertTask puts a task's content back to how it was at a revision.
+// The revert is itself a new revision, so it can be undone the same way.
+func RevertTask(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid Task ID", http.StatusBadRequest)
+		return
+	}
+	revision, err := strconv.Atoi(mux.Vars(r)["revision"])
+	if err != nil {
+		utils.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	if !canSeeTask(r, id) {
+		utils.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := lockTask(ctx, tx, id)
+	if err != nil {
+		utils.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	if !checkIfMatch(w, r, before.ETag) {
+		return
+	}
+
+	var snapshot models.Task
+	err = tx.QueryRow(ctx,
+		"SELECT snapshot FROM task_revisions WHERE task_id=$1 AND revision=$2", id, revision,
+	).Scan(&snapshot)
+	if errors.Is(err, pgx.ErrNoRows) {
+		utils.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		return
+	}
+
+	task, err := saveTask(ctx, tx, middlewares.GetUserID(r), RevisionReverted, before, fieldsOf(snapshot))
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		utils.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", task.ETag)
+	json.NewEncoder(w).Encode(task)
+}
+
+// tagsOrEmpty covers snapshots taken before tasks had tags.
+func tagsOrEmpty(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"task-api/db"
+	"task-api/models"
+	"task-api/utils"
+)
+
+// issueToken records a new session for the user and writes the same
+// {"token": ...} response Login has always returned. mfa marks sessions
+// that were established with a second factor.
+func issueToken(w http.ResponseWriter, r *http.Request, user models.User, mfa bool) {
+	var sessionID uuid.UUID
+	err := db.Pool.QueryRow(
+		context.Background(),
+		`INSERT INTO sessions (user_id, ip, user_agent, mfa) VALUES ($1, $2, $3, $4) RETURNING id`,
+		user.ID, clientIP(r), r.UserAgent(), mfa,
+	).Scan(&sessionID)
+	if err != nil {
+		utils.Error(w, "Session error", http.StatusInternalServerError)
+		return
+	}
+
+	tokenString, err := signToken(user.ID.String(), user.Role, sessionID.String())
+	if err != nil {
+		utils.Error(w, "Token error", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, user.ID, AuditLogin, "user", user.ID.String(), nil, map[string]interface{}{
+		"session_id": sessionID,
+		"mfa":        mfa,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+}
+
+func signToken(userID, role, sessionID string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userID,
+		"role":    role,
+		"sid":     sessionID,
+		"exp":     time.Now().Add(24 * time.Hour).Unix(),
+	})
+
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+}
+
+// revokeSessions logs the user out everywhere.
+func revokeSessions(ctx context.Context, q db.Querier, userID uuid.UUID) error {
+	_, err := q.Exec(ctx, "UPDATE sessions SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL", userID)
+	return err
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -6,22 +6,17 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 
 	// "strconv"
-	"strings"
 
 	"task-api/db"
 	"task-api/middlewares"
 	"task-api/models"
 	"task-api/utils"
 
-	"github.com/cloudinary/cloudinary-go/v2"
-	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
 // var tasks = []models.Task{}
@@ -36,14 +31,14 @@ func GetTasks(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	if role == "admin" {
-		rows, err = db.Pool.Query(context.Background(), "SELECT id, title, details, done, image_url, user_id FROM tasks")
+		rows, err = db.Pool.Query(context.Background(), "SELECT "+taskColumns+" FROM tasks WHERE archived_at IS NULL AND deleted_at IS NULL ORDER BY id")
 	} else {
-		rows, err = db.Pool.Query(context.Background(), "SELECT id, title, details, done, image_url, user_id FROM tasks WHERE user_id=$1", userID)
+		rows, err = db.Pool.Query(context.Background(), "SELECT "+taskColumns+" FROM tasks WHERE user_id=$1 AND deleted_at IS NULL ORDER BY id", userID)
 	}
 
 	if err != nil {
 		log.Printf("GetTask error: %v", err)
-		http.Error(w, "Failed to fetch tasks", http.StatusInternalServerError)
+		utils.Error(w, "Failed to fetch tasks", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
@@ -51,94 +46,85 @@ func GetTasks(w http.ResponseWriter, r *http.Request) {
 	var tasks []models.Task
 	for rows.Next() {
 		var task models.Task
-		err := rows.Scan(&task.ID, &task.Title, &task.Details, &task.Done, &task.ImageURL, &task.UserID)
+		err := scanTask(rows, &task)
 		if err != nil {
-			http.Error(w, "Failed to parse task", http.StatusInternalServerError)
+			utils.Error(w, "Failed to parse task", http.StatusInternalServerError)
 			return
 		}
 		tasks = append(tasks, task)
 	}
 
+	if notModified(w, r, tasksETag(tasks)) {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(tasks)
 }
 
 // CreateTask godoc
 // @Summary      Create a new task with optional image
-// @Description  Adds a task and uploads image to Cloudinary
+// @Description  Adds a task from a JSON body, or from a form that may upload an image to Cloudinary
 // @Tags         tasks
-// @Accept       mpfd
+// @Accept       json,mpfd
 // @Produce      json
 // @Param        title formData string true "Task title"
 // @Param        details formData string false "Task details"
 // @Param        done formData boolean false "Is task done?"
+// @Param        due_at formData string false "Due date (RFC 3339)"
+// @Param        tags formData string false "Comma-separated tags"
+// @Param        recurrence formData string false "iCalendar RRULE, e.g. FREQ=WEEKLY;BYDAY=MO"
+// @Param        priority formData string false "low, medium or high"
 // @Param        image formData file false "Image file to upload"
 // @Success      201 {object} models.Task
-// @Failure      400 {string} string "Bad request"
-// @Failure      500 {string} string "Internal error"
+// @Failure      400 {object} utils.Problem "Bad request"
+// @Failure      422 {object} utils.Problem "Invalid fields"
+// @Failure      500 {object} utils.Problem "Internal error"
 // @Router       /tasks [post]
 func CreateTask(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(20 << 20) // 20MB max
-	if err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+	f, ok := parseTaskFields(w, r)
+	if !ok {
 		return
 	}
 
-	title := strings.TrimSpace(r.FormValue("title"))
-	details := r.FormValue("details")
-	doneStr := r.FormValue("done")
-
-	if title == "" {
-		http.Error(w, "Title is required", http.StatusBadRequest)
+	task, err := createTask(middlewares.GetUserID(r), f)
+	if err != nil {
+		utils.Error(w, "Failed to create task", http.StatusInternalServerError)
 		return
 	}
 
-	done := false
-	if strings.ToLower(doneStr) == "true" {
-		done = true
-	}
-
-	var imageURL string
-
-	// Optional image upload
-	file, _, err := r.FormFile("image")
-	if err == nil {
-		defer file.Close()
-
-		cld, err := cloudinary.NewFromParams(
-			os.Getenv("CLOUDINARY_CLOUD_NAME"),
-			os.Getenv("CLOUDINARY_API_KEY"),
-			os.Getenv("CLOUDINARY_API_SECRET"),
-		)
-		if err != nil {
-			http.Error(w, "Cloudinary config failed", http.StatusInternalServerError)
-			return
-		}
-
-		uploadResp, err := cld.Upload.Upload(context.Background(), file, uploader.UploadParams{})
-		if err != nil {
-			http.Error(w, "Failed to upload image", http.StatusInternalServerError)
-			return
-		}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", task.ETag)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(task)
+}
 
-		fmt.Printf("Cloudinary Upload Response: %+v\n", uploadResp)
-		imageURL = uploadResp.SecureURL
-		fmt.Println("Final image URL:", imageURL)
+// createTask saves validated fields as a new task of userID, records the
+// revision and emails the owner.
+func createTask(userID uuid.UUID, f taskFields) (models.Task, error) {
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return models.Task{}, err
 	}
+	defer tx.Rollback(ctx)
 
-	userID := middlewares.GetUserID(r)
 	var task models.Task
-	err = db.Pool.QueryRow(
-		context.Background(),
-		`INSERT INTO tasks (title, details, done, image_url, user_id)
-	 VALUES ($1, $2, $3, $4, $5)
-	 RETURNING id, title, details, done, image_url, user_id`,
-		title, details, done, imageURL, userID,
-	).Scan(&task.ID, &task.Title, &task.Details, &task.Done, &task.ImageURL, &task.UserID)
-
+	err = scanTask(tx.QueryRow(
+		ctx,
+		`INSERT INTO tasks (title, details, done, image_url, due_at, tags, recurrence, priority, user_id)
+	 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	 RETURNING `+taskColumns,
+		f.Title, f.Details, f.Done, f.ImageURL, f.DueAt, f.Tags, f.Recurrence, f.Priority, userID,
+	), &task)
+	if err == nil {
+		err = recordRevision(ctx, tx, userID, RevisionCreated, nil, task)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
 	if err != nil {
-		http.Error(w, "Failed to create task", http.StatusInternalServerError)
-		return
+		return task, err
 	}
 
 	var userEmail string
@@ -147,10 +133,7 @@ func CreateTask(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		go utils.SendEmail(userEmail, "New Task Created", fmt.Sprintf("Hi, your task '%s' has been created!", task.Title))
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(task)
+	return task, nil
 }
 
 // Get Tak by ID
@@ -158,18 +141,22 @@ func GetTaskByID(w http.ResponseWriter, r *http.Request) {
 	idStr := mux.Vars(r)["id"]
 	id, err := uuid.Parse(idStr)
 	if err != nil {
-		http.Error(w, "Invalid Task ID", http.StatusBadRequest)
+		utils.Error(w, "Invalid Task ID", http.StatusBadRequest)
 		return
 	}
 
 	var task models.Task
-	err = db.Pool.QueryRow(
+	err = scanTask(db.Pool.QueryRow(
 		context.Background(),
-		"SELECT id, title, details, done, image_url, user_id FROM tasks WHERE id=$1", id,
-	).Scan(&task.ID, &task.Title, &task.Details, &task.Done, &task.ImageURL, &task.UserID)
+		"SELECT "+taskColumns+" FROM tasks WHERE id=$1 AND archived_at IS NULL AND deleted_at IS NULL", id,
+	), &task)
 
 	if err != nil {
-		http.Error(w, "Task not found", http.StatusNotFound)
+		utils.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	if notModified(w, r, task.ETag) {
 		return
 	}
 
@@ -179,103 +166,80 @@ func GetTaskByID(w http.ResponseWriter, r *http.Request) {
 
 // UpdateTask godoc
 // @Summary      Update a task (including image)
-// @Description  Updates task fields and optionally replaces the image
+// @Description  Replaces task fields from a JSON body or a form, optionally uploading a new image. The image is kept unless a new one is given.
 // @Tags         tasks
-// @Accept       mpfd
+// @Accept       json,mpfd
 // @Produce      json
 // @Param        id path int true "Task ID"
 // @Param        title formData string true "Task title"
 // @Param        details formData string false "Task details"
 // @Param        done formData boolean false "Done status"
+// @Param        due_at formData string false "Due date (RFC 3339)"
+// @Param        tags formData string false "Comma-separated tags"
+// @Param        recurrence formData string false "iCalendar RRULE, e.g. FREQ=WEEKLY;BYDAY=MO"
+// @Param        priority formData string false "low, medium or high"
 // @Param        image formData file false "New image file"
 // @Success      200 {object} models.Task
-// @Failure      400 {string} string "Bad request"
-// @Failure      404 {string} string "Task not found"
+// @Failure      400 {object} utils.Problem "Bad request"
+// @Failure      403 {object} utils.Problem "Not the task's owner"
+// @Failure      404 {object} utils.Problem "Task not found"
+// @Failure      422 {object} utils.Problem "Invalid fields"
 // @Router       /tasks/{id} [put]
 func UpdateTask(w http.ResponseWriter, r *http.Request) {
 	idStr := mux.Vars(r)["id"]
 	id, err := uuid.Parse(idStr)
 	if err != nil {
-		http.Error(w, "Invalid Task ID", http.StatusBadRequest)
+		utils.Error(w, "Invalid Task ID", http.StatusBadRequest)
 		return
 	}
 
-	err = r.ParseMultipartForm(20 << 20)
-	if err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+	f, ok := parseTaskFields(w, r)
+	if !ok {
 		return
 	}
 
-	title := strings.TrimSpace(r.FormValue("title"))
-	if title == "" {
-		http.Error(w, "Title is required", http.StatusBadRequest)
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Failed to update task", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback(ctx)
 
-	details := r.FormValue("details")
-	doneStr := r.FormValue("done")
-	done := false
-	if strings.ToLower(doneStr) == "true" {
-		done = true
+	before, err := lockTask(ctx, tx, id)
+	if err != nil {
+		utils.Error(w, "Task not found or update failed", http.StatusNotFound)
+		return
 	}
 
-	imageURL := ""
-
-	// Optional image upload
-	file, _, err := r.FormFile("image")
-	if err == nil {
-		defer file.Close()
-
-		cld, err := cloudinary.NewFromParams(
-			os.Getenv("CLOUDINARY_CLOUD_NAME"),
-			os.Getenv("CLOUDINARY_API_KEY"),
-			os.Getenv("CLOUDINARY_API_SECRET"),
-		)
-		if err != nil {
-			http.Error(w, "Cloudinary config failed", http.StatusInternalServerError)
-			return
-		}
-
-		uploadResp, err := cld.Upload.Upload(context.Background(), file, uploader.UploadParams{})
-		if err != nil {
-			http.Error(w, "Image upload failed", http.StatusInternalServerError)
-			return
-		}
-
-		imageURL = uploadResp.SecureURL
+	// Before If-Match, so another user's ETag isn't given away by a 412
+	userID := middlewares.GetUserID(r)
+	if !middlewares.ActsAsAdmin(r) && before.UserID != userID {
+		utils.Error(w, "Not authorized to update this task", http.StatusForbidden)
+		return
 	}
 
-	var commandTag pgconn.CommandTag
-	if imageURL != "" {
-		commandTag, err = db.Pool.Exec(context.Background(),
-			"UPDATE tasks SET title=$1, details=$2, done=$3, image_url=$4 WHERE id=$5",
-			title, details, done, imageURL, id,
-		)
-	} else {
-		commandTag, err = db.Pool.Exec(context.Background(),
-			"UPDATE tasks SET title=$1, details=$2, done=$3 WHERE id=$4",
-			title, details, done, id,
-		)
+	if !checkIfMatch(w, r, before.ETag) {
+		return
 	}
 
-	if err != nil || commandTag.RowsAffected() == 0 {
-		http.Error(w, "Task not found or update failed", http.StatusNotFound)
-		return
+	// Keep the current image unless a new one was given; PATCH can clear it
+	if f.ImageURL == "" {
+		f.ImageURL = before.ImageURL
 	}
 
-	// Return updated task
-	var updatedTask models.Task
-	err = db.Pool.QueryRow(
-		context.Background(),
-		"SELECT id, title, details, done, image_url FROM tasks WHERE id=$1", id,
-	).Scan(&updatedTask.ID, &updatedTask.Title, &updatedTask.Details, &updatedTask.Done, &updatedTask.ImageURL)
+	updatedTask, err := saveTask(ctx, tx, userID, RevisionUpdated, before, f)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
 
 	if err != nil {
-		http.Error(w, "Failed to fetch updated task", http.StatusInternalServerError)
+		utils.Error(w, "Failed to update task", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", updatedTask.ETag)
 	json.NewEncoder(w).Encode(updatedTask)
 }
 
@@ -290,27 +254,51 @@ func DeleteTask(w http.ResponseWriter, r *http.Request) {
 	if role != "admin" {
 		var ownerID uuid.UUID
 		err := db.Pool.QueryRow(context.Background(),
-			"SELECT user_id FROM tasks WHERE id=$1", id,
+			"SELECT user_id FROM tasks WHERE id=$1 AND deleted_at IS NULL", id,
 		).Scan(&ownerID)
 
 		if err != nil || ownerID != userID {
-			http.Error(w, "Not authorized to delete this task", http.StatusForbidden)
+			utils.Error(w, "Not authorized to delete this task", http.StatusForbidden)
 			return
 		}
 	}
 
 	if err != nil {
-		http.Error(w, "Invalid Task ID", http.StatusBadRequest)
+		utils.Error(w, "Invalid Task ID", http.StatusBadRequest)
+		return
+	}
+
+	// Deleting only moves the task to the trash; see trash.go
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Delete failed", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback(ctx)
 
-	commandTag, err := db.Pool.Exec(context.Background(), "DELETE FROM tasks WHERE id=$1", id)
+	current, err := lockTask(ctx, tx, id)
+	if err != nil {
+		utils.Error(w, "Delete failed", http.StatusNotFound)
+		return
+	}
 
-	if err != nil || commandTag.RowsAffected() == 0 {
-		http.Error(w, "Delete failed", http.StatusNotFound)
+	if !checkIfMatch(w, r, current.ETag) {
 		return
 	}
 
+	deleted, err := trashTask(ctx, tx, userID, current)
+	if err != nil {
+		utils.Error(w, "Delete failed", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		utils.Error(w, "Delete failed", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, userID, AuditTaskDeleted, "task", id.String(), deleted, nil)
+
 	w.WriteHeader(http.StatusNoContent)
 
 }
@@ -323,9 +311,9 @@ func GetUserTasks(w http.ResponseWriter, r *http.Request) {
 	idStr := mux.Vars(r)["id"]
 	userID, _ := uuid.Parse(idStr)
 
-	rows, err := db.Pool.Query(context.Background(), "SELECT id, title, details, done, image_url, user_id FROM tasks WHERE user_id=$1", userID)
+	rows, err := db.Pool.Query(context.Background(), "SELECT "+taskColumns+" FROM tasks WHERE user_id=$1 AND deleted_at IS NULL", userID)
 	if err != nil {
-		http.Error(w, "Error fetching tasks", http.StatusInternalServerError)
+		utils.Error(w, "Error fetching tasks", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
@@ -333,10 +321,76 @@ func GetUserTasks(w http.ResponseWriter, r *http.Request) {
 	var tasks []models.Task
 	for rows.Next() {
 		var task models.Task
-		rows.Scan(&task.ID, &task.Title, &task.Details, &task.Done, &task.ImageURL, &task.UserID)
+		scanTask(rows, &task)
 		tasks = append(tasks, task)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(tasks)
 }
+
+const taskColumns = "id, title, details, done, image_url, due_at, tags, recurrence, priority, user_id, version"
+
+// scanTask reads a row selected with taskColumns (plus any extra
+// destinations) and fills in the ETag.
+func scanTask(row pgx.Row, task *models.Task, extra ...interface{}) error {
+	dest := append([]interface{}{&task.ID, &task.Title, &task.Details, &task.Done, &task.ImageURL, &task.DueAt, &task.Tags,
+		&task.Recurrence, &task.Priority, &task.UserID, &task.Version}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	task.ETag = taskETag(task.Version)
+	return nil
+}
+
+// lockTask loads a live task and locks its row for the rest of the
+// transaction, so the revision recorded matches what was overwritten.
+func lockTask(ctx context.Context, tx pgx.Tx, id uuid.UUID) (models.Task, error) {
+	var task models.Task
+	err := scanTask(tx.QueryRow(ctx,
+		"SELECT "+taskColumns+" FROM tasks WHERE id=$1 AND archived_at IS NULL AND deleted_at IS NULL FOR UPDATE", id,
+	), &task)
+	return task, err
+}
+
+func fieldsOf(task models.Task) taskFields {
+	return taskFields{
+		Title:      task.Title,
+		Details:    task.Details,
+		Done:       task.Done,
+		DueAt:      task.DueAt,
+		Tags:       tagsOrEmpty(task.Tags),
+		Recurrence: task.Recurrence,
+		Priority:   task.Priority,
+		ImageURL:   task.ImageURL,
+	}
+}
+
+// saveTask writes validated fields over a task locked with lockTask and
+// records the revision.
+func saveTask(ctx context.Context, tx pgx.Tx, actorID uuid.UUID, action string, before models.Task, f taskFields) (models.Task, error) {
+	var task models.Task
+	err := scanTask(tx.QueryRow(ctx,
+		`UPDATE tasks SET title=$1, details=$2, done=$3, image_url=$4, due_at=$5, tags=$6, recurrence=$7, priority=$8, version=version+1
+		 WHERE id=$9 RETURNING `+taskColumns,
+		f.Title, f.Details, f.Done, f.ImageURL, f.DueAt, tagsOrEmpty(f.Tags), f.Recurrence, f.Priority, before.ID,
+	), &task)
+	if err != nil {
+		return task, err
+	}
+	return task, recordRevision(ctx, tx, actorID, action, &before, task)
+}
+
+// trashTask moves a task locked with lockTask to the trash and records
+// the revision.
+func trashTask(ctx context.Context, tx pgx.Tx, actorID uuid.UUID, before models.Task) (models.Task, error) {
+	var task models.Task
+	err := scanTask(tx.QueryRow(ctx,
+		`UPDATE tasks SET deleted_at=now(), deleted_by=$2, version=version+1
+		 WHERE id=$1 RETURNING `+taskColumns+`, deleted_at`, before.ID, actorID,
+	), &task, &task.DeletedAt)
+	if err != nil {
+		return task, err
+	}
+	return task, recordRevision(ctx, tx, actorID, RevisionDeleted, &task, task)
+}
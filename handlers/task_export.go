@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+// Formats for task import and export
+const (
+	formatCSV     = "csv"
+	formatJSON    = "json"
+	formatTodoTxt = "todotxt"
+	formatICS     = "ics"
+)
+
+// csvColumns is the header GET /tasks/export writes and POST /tasks/import
+// expects unless columns are mapped.
+var csvColumns = []string{"external_id", "title", "details", "done", "due_at", "tags", "recurrence", "priority", "image_url"}
+
+// taskRecord is a task as it is exported and imported: its fields plus
+// the id it is known by elsewhere. Exported tasks without an external id
+// carry their own id, so importing a backup again finds them.
+type taskRecord struct {
+	ExternalID string `json:"external_id,omitempty"`
+	taskFields
+}
+
+// ExportTasks godoc
+// @Summary      Export your tasks
+// @Description  Streams the caller's live tasks as CSV, a JSON array, todo.txt or an iCalendar file of VTODOs. todo.txt has no room for details, recurrence or images, so they are left out.
+// @Tags         tasks
+// @Produce      json,plain
+// @Param        format query string false "csv, json (default), todotxt or ics"
+// @Success      200 {array} taskRecord
+// @Failure      400 {object} utils.Problem "Unknown format"
+// @Router       /tasks/export [get]
+func ExportTasks(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatJSON
+	}
+
+	var write func(io.Writer, taskRecord) error
+	var finish func(io.Writer) error
+	switch format {
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="tasks.csv"`)
+		cw.Write(csvColumns)
+		write = func(_ io.Writer, rec taskRecord) error {
+			return cw.Write(csvRow(rec))
+		}
+		finish = func(io.Writer) error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case formatJSON:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="tasks.json"`)
+		io.WriteString(w, "[")
+		first := true
+		write = func(w io.Writer, rec taskRecord) error {
+			b, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if !first {
+				io.WriteString(w, ",")
+			}
+			first = false
+			_, err = w.Write(append([]byte("\n"), b...))
+			return err
+		}
+		finish = func(w io.Writer) error {
+			_, err := io.WriteString(w, "\n]\n")
+			return err
+		}
+	case formatTodoTxt:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="todo.txt"`)
+		write = func(w io.Writer, rec taskRecord) error {
+			_, err := io.WriteString(w, todoTxtLine(rec)+"\n")
+			return err
+		}
+		finish = func(io.Writer) error { return nil }
+	case formatICS:
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="tasks.ics"`)
+		cal := taskCalendar()
+		stamp := utils.ICalTime(time.Now())
+		write = func(_ io.Writer, rec taskRecord) error {
+			cal.Components = append(cal.Components, icalTodo(rec, stamp))
+			return nil
+		}
+		finish = func(w io.Writer) error {
+			return utils.WriteICal(w, cal)
+		}
+	default:
+		utils.Error(w, "format must be csv, json, todotxt or ics", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		"SELECT "+taskColumns+`, COALESCE(external_id, id::text)
+		 FROM tasks WHERE user_id=$1 AND archived_at IS NULL AND deleted_at IS NULL ORDER BY id`,
+		middlewares.GetUserID(r))
+	if err != nil {
+		utils.Error(w, "Failed to fetch tasks", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// The header is out once the first byte is; from here errors can
+	// only cut the stream short
+	for rows.Next() {
+		var task models.Task
+		var rec taskRecord
+		if err = scanTask(rows, &task, &rec.ExternalID); err != nil {
+			break
+		}
+		rec.taskFields = fieldsOf(task)
+		if err = write(w, rec); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil {
+		err = finish(w)
+	}
+	if err != nil {
+		log.Printf("ExportTasks error: %v", err)
+	}
+}
+
+func csvRow(rec taskRecord) []string {
+	due := ""
+	if rec.DueAt != nil {
+		due = rec.DueAt.UTC().Format(time.RFC3339)
+	}
+	row := []string{rec.ExternalID, rec.Title, rec.Details, strconv.FormatBool(rec.Done), due,
+		strings.Join(rec.Tags, ","), rec.Recurrence, rec.Priority, rec.ImageURL}
+	for i := range row {
+		row[i] = csvCell(row[i])
+	}
+	return row
+}
+
+// csvCell stops spreadsheets from running a cell as a formula by putting
+// a quote before a leading =, +, -, @, tab or carriage return.
+// parseCSVImport takes it off again.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// todoTxtLine writes a task in todo.txt form: "x" when done, the
+// priority as (A) to (C), the title, tags as +projects, then due: and id:
+// keys. Due dates at midnight UTC
+// are written as plain dates, others as RFC 3339.
+func todoTxtLine(rec taskRecord) string {
+	parts := []string{}
+	if rec.Done {
+		parts = append(parts, "x")
+	}
+	if letter := todoTxtPriorities[rec.Priority]; letter != "" {
+		parts = append(parts, "("+letter+")")
+	}
+	parts = append(parts, strings.Fields(rec.Title)...)
+	for _, tag := range rec.Tags {
+		parts = append(parts, "+"+tag)
+	}
+	if rec.DueAt != nil {
+		if isDateOnly(*rec.DueAt) {
+			parts = append(parts, "due:"+rec.DueAt.UTC().Format(time.DateOnly))
+		} else {
+			parts = append(parts, "due:"+rec.DueAt.UTC().Format(time.RFC3339))
+		}
+	}
+	if rec.ExternalID != "" {
+		parts = append(parts, "id:"+rec.ExternalID)
+	}
+	return strings.Join(parts, " ")
+}
+
+var todoTxtPriorities = map[string]string{priorityHigh: "A", priorityMedium: "B", priorityLow: "C"}
+
+// isDateOnly is whether a due date is a plain date, which is how dates
+// without a time are stored: midnight UTC.
+func isDateOnly(t time.Time) bool {
+	t = t.UTC()
+	return t.Equal(t.Truncate(24 * time.Hour))
+}
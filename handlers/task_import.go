@@ -0,0 +1,539 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+const (
+	maxImportBytes      = 10 << 20
+	maxImportRows       = 5000
+	maxExternalIDLength = 255
+)
+
+// Per-row import outcomes. A dry run reports what would have happened.
+const (
+	importCreated   = "created"
+	importUpdated   = "updated"
+	importDuplicate = "duplicate"
+	importInvalid   = "invalid"
+)
+
+var errTooManyRows = fmt.Errorf("an import can have at most %d rows", maxImportRows)
+
+// importRecord is one parsed row: for CSV and todo.txt Row is its line
+// in the file, for JSON and iCalendar its position (from 1).
+type importRecord struct {
+	Row    int
+	Record taskRecord
+	Errors fieldErrors
+}
+
+type importResult struct {
+	Row        int         `json:"row"`
+	Status     string      `json:"status"`
+	ExternalID string      `json:"external_id,omitempty"`
+	TaskID     *uuid.UUID  `json:"task_id,omitempty"`
+	Errors     fieldErrors `json:"errors,omitempty"`
+}
+
+// ImportTasks godoc
+// @Summary      Import tasks
+// @Description  Creates tasks from CSV, a JSON array, todo.txt or the VTODOs of an iCalendar file, sent as the body or as the "file" field of a form. CSV headers and JSON keys can be mapped onto task fields with map.<field>=<column>. Rows whose external_id matches a task of yours (or its id) are skipped as duplicates, or updated with on_duplicate=update. Invalid rows are reported and skipped. With dry_run=true nothing is saved.
+// @Tags         tasks
+// @Accept       json,plain,mpfd
+// @Produce      json
+// @Param        format query string false "csv, json, todotxt or ics; by default taken from the Content-Type or file name"
+// @Param        dry_run query boolean false "Validate and report only"
+// @Param        on_duplicate query string false "skip (default) or update"
+// @Success      200 {object} map[string]interface{}
+// @Failure      400 {object} utils.Problem "Unreadable file"
+// @Failure      413 {object} utils.Problem "Too many rows"
+// @Failure      422 {object} utils.Problem "Invalid mapping"
+// @Router       /tasks/import [post]
+func ImportTasks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dryRun := query.Get("dry_run") == "true"
+	update := false
+	switch query.Get("on_duplicate") {
+	case "", "skip":
+	case "update":
+		update = true
+	default:
+		utils.ValidationError(w, "Invalid import options", fieldErrors{"on_duplicate": "must be skip or update"})
+		return
+	}
+
+	userID := middlewares.GetUserID(r)
+	mapping, errs := importMapping(query)
+	if len(errs) > 0 {
+		utils.ValidationError(w, "Invalid column mapping", errs)
+		return
+	}
+
+	body, format, ok := importBody(w, r)
+	if !ok {
+		return
+	}
+	defer body.Close()
+
+	var records []importRecord
+	var err error
+	switch format {
+	case formatCSV:
+		records, errs, err = parseCSVImport(body, mapping)
+	case formatJSON:
+		records, err = parseJSONImport(body, mapping)
+	case formatTodoTxt:
+		records, err = parseTodoTxtImport(body)
+	case formatICS:
+		records, err = parseICSImport(body, userLocation(userID))
+	default:
+		utils.Error(w, "format must be csv, json, todotxt or ics", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(errs) > 0:
+		utils.ValidationError(w, "Invalid column mapping", errs)
+		return
+	case errors.Is(err, errTooManyRows):
+		utils.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		utils.Error(w, "Failed to read "+format+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Import failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+	if err := lockSyncSeq(ctx, tx, userID); err != nil {
+		utils.Error(w, "Import failed", http.StatusInternalServerError)
+		return
+	}
+
+	// Everything runs for real in the transaction; a dry run just does
+	// not commit it
+	results := make([]importResult, 0, len(records))
+	counts := map[string]int{importCreated: 0, importUpdated: 0, importDuplicate: 0, importInvalid: 0}
+	seen := map[string]bool{}
+	for _, rec := range records {
+		res, err := importTask(ctx, tx, userID, rec, update, seen)
+		if err != nil {
+			utils.Error(w, "Import failed", http.StatusInternalServerError)
+			return
+		}
+		if dryRun && res.Status == importCreated {
+			res.TaskID = nil
+		}
+		counts[res.Status]++
+		results = append(results, res)
+	}
+
+	if !dryRun {
+		if err := tx.Commit(ctx); err != nil {
+			utils.Error(w, "Import failed", http.StatusInternalServerError)
+			return
+		}
+		audit(r, userID, AuditTasksImported, "user", userID.String(), nil, map[string]interface{}{"format": format, "counts": counts})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run": dryRun,
+		"counts":  counts,
+		"rows":    results,
+	})
+}
+
+// importMapping reads map.<field>=<column> parameters into field → column.
+func importMapping(query url.Values) (map[string]string, fieldErrors) {
+	mapping := map[string]string{}
+	errs := fieldErrors{}
+	for key, values := range query {
+		field, ok := strings.CutPrefix(key, "map.")
+		if !ok {
+			continue
+		}
+		switch {
+		case !isImportField(field):
+			errs[key] = "is not a task field; use one of " + strings.Join(csvColumns, ", ")
+		case strings.TrimSpace(values[0]) == "":
+			errs[key] = "must name a column"
+		default:
+			mapping[field] = strings.TrimSpace(values[0])
+		}
+	}
+	return mapping, errs
+}
+
+func isImportField(field string) bool {
+	for _, column := range csvColumns {
+		if column == field {
+			return true
+		}
+	}
+	return false
+}
+
+// importBody finds the file in the request, either the whole body or the
+// "file" field of a multipart form, and its format.
+func importBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, string, bool) {
+	format := r.URL.Query().Get("format")
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		// The form around the file gets a little room of its own
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes+1<<20)
+		if err := r.ParseMultipartForm(maxImportBytes); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				utils.Error(w, "Import file too large", http.StatusRequestEntityTooLarge)
+				return nil, "", false
+			}
+			utils.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return nil, "", false
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			utils.ValidationError(w, "Invalid import", fieldErrors{"file": "is required"})
+			return nil, "", false
+		}
+		if format == "" {
+			format = importFormatOf(strings.ToLower(path.Ext(header.Filename)), header.Header.Get("Content-Type"))
+		}
+		return file, format, true
+	}
+
+	if format == "" {
+		format = importFormatOf("", mediaType)
+	}
+	return http.MaxBytesReader(w, r.Body, maxImportBytes), format, true
+}
+
+func importFormatOf(ext, mediaType string) string {
+	mediaType, _, _ = mime.ParseMediaType(mediaType)
+	switch {
+	case ext == ".csv" || mediaType == "text/csv":
+		return formatCSV
+	case ext == ".json" || mediaType == "application/json":
+		return formatJSON
+	case ext == ".txt" || mediaType == "text/plain":
+		return formatTodoTxt
+	case ext == ".ics" || mediaType == "text/calendar":
+		return formatICS
+	}
+	return ""
+}
+
+// parseImportDate takes an RFC 3339 date-time or, as spreadsheets and
+// todo.txt write them, a plain date (midnight UTC).
+func parseImportDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// parseCSVImport reads a CSV file with a header row. Each task field is
+// read from the column named like it, or from the column mapped to it;
+// other columns are ignored. Values are read as form values are. A
+// mapping that names a missing column comes back as field errors.
+func parseCSVImport(body io.Reader, mapping map[string]string) ([]importRecord, fieldErrors, error) {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff") // byte order mark
+	}
+
+	columns := map[string]int{}
+	errs := fieldErrors{}
+	for _, field := range csvColumns {
+		name, mapped := mapping[field]
+		if !mapped {
+			name = field
+		}
+		for i, column := range header {
+			if strings.EqualFold(strings.TrimSpace(column), name) {
+				columns[field] = i
+				break
+			}
+		}
+		if _, found := columns[field]; !found && mapped {
+			errs["map."+field] = fmt.Sprintf("there is no column named %q", name)
+		}
+	}
+	if _, found := columns["title"]; !found {
+		if _, ok := errs["map.title"]; !ok {
+			errs["map.title"] = "there is no title column; name one with map.title"
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs, nil
+	}
+
+	records := []importRecord{}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(records) == maxImportRows {
+			return nil, nil, errTooManyRows
+		}
+
+		form := url.Values{}
+		for field, i := range columns {
+			if i < len(row) {
+				value := row[i]
+				if len(value) > 1 && value[0] == '\'' && csvCell(value[1:]) != value[1:] {
+					value = value[1:]
+				}
+				form.Set(field, value)
+			}
+		}
+		if due, err := parseImportDate(strings.TrimSpace(form.Get("due_at"))); err == nil {
+			form.Set("due_at", due.Format(time.RFC3339))
+		}
+
+		f, errs := taskFieldsFromForm(form)
+		records = append(records, importRecord{
+			Row:    line,
+			Record: taskRecord{ExternalID: strings.TrimSpace(form.Get("external_id")), taskFields: f},
+			Errors: errs,
+		})
+	}
+	return records, nil, nil
+}
+
+// parseJSONImport reads a JSON array of objects with the fields GET
+// /tasks/export writes, under their own keys or mapped ones. Other keys
+// are ignored.
+func parseJSONImport(body io.Reader, mapping map[string]string) ([]importRecord, error) {
+	var objects []map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&objects); err != nil {
+		return nil, err
+	}
+	if len(objects) > maxImportRows {
+		return nil, errTooManyRows
+	}
+
+	records := []importRecord{}
+	for i, object := range objects {
+		fields := map[string]json.RawMessage{}
+		for _, field := range csvColumns {
+			key, mapped := mapping[field]
+			if !mapped {
+				key = field
+			}
+			if value, ok := object[key]; ok {
+				fields[field] = value
+			}
+		}
+
+		// An external id may be a number in the other system
+		var externalID string
+		if raw, ok := fields["external_id"]; ok {
+			if json.Unmarshal(raw, &externalID) != nil {
+				externalID = string(raw)
+			}
+			delete(fields, "external_id")
+		}
+
+		doc, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		f, errs, err := decodeTaskJSON(bytes.NewReader(doc))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, importRecord{
+			Row:    i + 1,
+			Record: taskRecord{ExternalID: strings.TrimSpace(externalID), taskFields: f},
+			Errors: errs,
+		})
+	}
+	return records, nil
+}
+
+var todoTxtPriority = regexp.MustCompile(`^\([A-Z]\)$`)
+
+// parseTodoTxtImport reads one task per non-blank line: a leading "x"
+// marks it done, (A) and (B) are high and medium priority and anything
+// lower is low, +project and @context words become tags, due: sets the
+// due date and id: the external id. Completion and creation dates are
+// dropped; other words make up the title.
+func parseTodoTxtImport(body io.Reader) ([]importRecord, error) {
+	records := []importRecord{}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportBytes)
+	for line := 1; scanner.Scan(); line++ {
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+		if len(records) == maxImportRows {
+			return nil, errTooManyRows
+		}
+
+		rec := taskRecord{}
+		errs := fieldErrors{}
+		if words[0] == "x" {
+			rec.Done = true
+			words = words[1:]
+		}
+		// Completion date, priority and creation date, in whatever order
+		for n := 0; n < 3 && len(words) > 0 && (isTodoTxtDate(words[0]) || todoTxtPriority.MatchString(words[0])); n++ {
+			switch words[0] {
+			case "(A)":
+				rec.Priority = priorityHigh
+			case "(B)":
+				rec.Priority = priorityMedium
+			default:
+				if !isTodoTxtDate(words[0]) {
+					rec.Priority = priorityLow
+				}
+			}
+			words = words[1:]
+		}
+
+		title := []string{}
+		for _, word := range words {
+			switch {
+			case len(word) > 1 && (word[0] == '+' || word[0] == '@'):
+				rec.Tags = append(rec.Tags, word[1:])
+			case strings.HasPrefix(word, "due:"):
+				due, err := parseImportDate(strings.TrimPrefix(word, "due:"))
+				if err != nil {
+					errs["due_at"] = "must be a date (YYYY-MM-DD) or an RFC 3339 date-time"
+				} else {
+					rec.DueAt = &due
+				}
+			case strings.HasPrefix(word, "id:") && len(word) > len("id:"):
+				rec.ExternalID = strings.TrimPrefix(word, "id:")
+			default:
+				title = append(title, word)
+			}
+		}
+		rec.Title = strings.Join(title, " ")
+
+		records = append(records, importRecord{Row: line, Record: rec, Errors: errs})
+	}
+	return records, scanner.Err()
+}
+
+func isTodoTxtDate(word string) bool {
+	_, err := time.Parse(time.DateOnly, word)
+	return err == nil
+}
+
+// importTask validates one record and creates it, or handles it as a
+// duplicate of a task the user already has (or of an earlier row).
+func importTask(ctx context.Context, tx pgx.Tx, userID uuid.UUID, rec importRecord, update bool, seen map[string]bool) (importResult, error) {
+	f := rec.Record.taskFields
+	externalID := rec.Record.ExternalID
+	res := importResult{Row: rec.Row, ExternalID: externalID}
+
+	errs := rec.Errors
+	f.validate(errs)
+	if len(externalID) > maxExternalIDLength {
+		errs["external_id"] = fmt.Sprintf("must be at most %d characters", maxExternalIDLength)
+	}
+	if len(errs) > 0 {
+		res.Status, res.Errors = importInvalid, errs
+		return res, nil
+	}
+
+	if externalID != "" {
+		if seen[externalID] {
+			res.Status = importDuplicate
+			return res, nil
+		}
+		seen[externalID] = true
+
+		var existing uuid.UUID
+		err := tx.QueryRow(ctx,
+			`SELECT id FROM tasks
+			 WHERE user_id=$1 AND archived_at IS NULL AND deleted_at IS NULL AND (external_id=$2 OR id::text=$2)
+			 ORDER BY external_id IS NULL LIMIT 1`,
+			userID, externalID,
+		).Scan(&existing)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return res, err
+		}
+		if err == nil {
+			res.TaskID = &existing
+			if !update {
+				res.Status = importDuplicate
+				return res, nil
+			}
+			before, err := lockTask(ctx, tx, existing)
+			if err != nil {
+				return res, err
+			}
+			if f.ImageURL == "" {
+				f.ImageURL = before.ImageURL
+			}
+			if _, err := saveTask(ctx, tx, userID, RevisionUpdated, before, f); err != nil {
+				return res, err
+			}
+			res.Status = importUpdated
+			return res, nil
+		}
+	}
+
+	var task models.Task
+	err := scanTask(tx.QueryRow(ctx,
+		`INSERT INTO tasks (title, details, done, image_url, due_at, tags, recurrence, priority, user_id, external_id)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''))
+		 RETURNING `+taskColumns,
+		f.Title, f.Details, f.Done, f.ImageURL, f.DueAt, f.Tags, f.Recurrence, f.Priority, userID, externalID,
+	), &task)
+	if err != nil {
+		return res, err
+	}
+	if err := recordRevision(ctx, tx, userID, RevisionCreated, nil, task); err != nil {
+		return res, err
+	}
+	res.Status, res.TaskID = importCreated, &task.ID
+	return res, nil
+}
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cloudinary/cloudinary-go/v2"
+	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
+
+	"task-api/utils"
+)
+
+const (
+	maxTitleLength   = 200
+	maxDetailsLength = 10000
+	maxTags          = 20
+	maxTagLength     = 32
+)
+
+// Task priorities, from most to least urgent; "" is none.
+const (
+	priorityHigh   = "high"
+	priorityMedium = "medium"
+	priorityLow    = "low"
+)
+
+// taskFields are the values a client can set on a task, under the JSON
+// names the task is returned with. Create, update and patch all go
+// through validate.
+type taskFields struct {
+	Title      string     `json:"title"`
+	Details    string     `json:"details"`
+	Done       bool       `json:"done"`
+	DueAt      *time.Time `json:"due_at"`
+	Tags       []string   `json:"tags"`
+	Recurrence string     `json:"recurrence"`
+	Priority   string     `json:"priority"`
+	ImageURL   string     `json:"image_url"`
+}
+
+// fieldErrors maps a field name to what is wrong with it.
+type fieldErrors map[string]string
+
+// validate normalises f in place (trimmed title, lower-cased unique tags)
+// and adds every invalid field to errs, keeping any error a field
+// already has from decoding.
+func (f *taskFields) validate(errs fieldErrors) {
+	f.validateOver("", errs)
+}
+
+// validateOver is validate for fields written over a task with image
+// storedImage, which stays valid even if it predates the upload-only
+// rule for image_url.
+func (f *taskFields) validateOver(storedImage string, errs fieldErrors) {
+	add := func(field, msg string) {
+		if _, ok := errs[field]; !ok {
+			errs[field] = msg
+		}
+	}
+
+	f.Title = strings.TrimSpace(f.Title)
+	switch {
+	case f.Title == "":
+		add("title", "is required")
+	case len([]rune(f.Title)) > maxTitleLength:
+		add("title", fmt.Sprintf("must be at most %d characters", maxTitleLength))
+	}
+
+	if len([]rune(f.Details)) > maxDetailsLength {
+		add("details", fmt.Sprintf("must be at most %d characters", maxDetailsLength))
+	}
+
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range f.Tags {
+		tag = normalizeTag(tag)
+		if msg := tagError(tag); msg != "" {
+			add("tags", msg)
+			break
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTags {
+		add("tags", fmt.Sprintf("must have at most %d entries", maxTags))
+	}
+	f.Tags = tags
+
+	if f.Recurrence != "" {
+		rule, err := utils.NormalizeRRule(f.Recurrence)
+		switch {
+		case err != nil:
+			add("recurrence", err.Error())
+		case f.DueAt == nil:
+			add("recurrence", "needs a due_at to repeat from")
+		default:
+			f.Recurrence = rule
+		}
+	}
+
+	f.Priority = strings.ToLower(strings.TrimSpace(f.Priority))
+	switch f.Priority {
+	case "", priorityHigh, priorityMedium, priorityLow:
+	default:
+		add("priority", "must be low, medium or high")
+	}
+
+	if f.ImageURL != "" && f.ImageURL != storedImage && !isUploadedImageURL(f.ImageURL) {
+		add("image_url", "must be an image uploaded with POST /upload-cloud")
+	}
+}
+
+// cloudinaryHost serves the images uploadTaskImage stores.
+const cloudinaryHost = "res.cloudinary.com"
+
+// isUploadedImageURL is whether raw points at an image in this app's
+// Cloudinary account. image_url is limited to those because the data
+// export downloads it from the server.
+func isUploadedImageURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Port() != "" || !strings.EqualFold(u.Hostname(), cloudinaryHost) {
+		return false
+	}
+	cloud := os.Getenv("CLOUDINARY_CLOUD_NAME")
+	return cloud != "" && strings.HasPrefix(u.Path, "/"+cloud+"/")
+}
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+// tagError says what is wrong with a normalised tag, or "" if nothing.
+func tagError(tag string) string {
+	if tag == "" || strings.ContainsAny(tag, ",#") || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+		return "must be single words without commas or #"
+	}
+	if len([]rune(tag)) > maxTagLength {
+		return fmt.Sprintf("must each be at most %d characters", maxTagLength)
+	}
+	return ""
+}
+
+func writeFieldErrors(w http.ResponseWriter, errs fieldErrors) {
+	utils.ValidationError(w, "Invalid task", errs)
+}
+
+// parseTaskFields reads a create or update body. application/json takes
+// typed fields; multipart/form-data (which can carry an image) and
+// urlencoded forms take the same fields as strings, with tags repeated
+// or comma-separated. The image is only uploaded once everything else
+// is valid. It writes the error response itself and returns false on
+// failure.
+func parseTaskFields(w http.ResponseWriter, r *http.Request) (taskFields, bool) {
+	var f taskFields
+	var errs fieldErrors
+	var image multipart.File
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var err error
+		f, errs, err = decodeTaskJSON(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			utils.Error(w, "Invalid request body", http.StatusBadRequest)
+			return f, false
+		}
+
+	case "multipart/form-data", "application/x-www-form-urlencoded":
+		if err := r.ParseMultipartForm(20 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			utils.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return f, false
+		}
+		f, errs = taskFieldsFromForm(r.Form)
+		if file, _, err := r.FormFile("image"); err == nil {
+			defer file.Close()
+			image = file
+		}
+
+	default:
+		utils.Error(w, "Content-Type must be application/json or multipart/form-data", http.StatusUnsupportedMediaType)
+		return f, false
+	}
+
+	f.validate(errs)
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return f, false
+	}
+
+	if image != nil {
+		imageURL, err := uploadTaskImage(image)
+		if err != nil {
+			utils.Error(w, "Failed to upload image", http.StatusInternalServerError)
+			return f, false
+		}
+		f.ImageURL = imageURL
+	}
+
+	return f, true
+}
+
+// decodeTaskJSON decodes a JSON body. A wrongly typed or unknown field
+// is a field error; only unparseable JSON is returned as err.
+func decodeTaskJSON(body io.Reader) (taskFields, fieldErrors, error) {
+	var f taskFields
+	errs := fieldErrors{}
+
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&f)
+
+	var typeErr *json.UnmarshalTypeError
+	var timeErr *time.ParseError
+	switch {
+	case err == nil:
+	case errors.As(err, &typeErr):
+		errs[typeErr.Field] = "must be a " + jsonTypeName(typeErr.Type.Kind().String())
+	case errors.As(err, &timeErr), strings.Contains(err.Error(), "Time.UnmarshalJSON"):
+		errs["due_at"] = "must be an RFC 3339 date-time"
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		errs[strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)] = "is not a task field"
+	default:
+		return f, nil, err
+	}
+	return f, errs, nil
+}
+
+func jsonTypeName(kind string) string {
+	switch kind {
+	case "bool":
+		return "boolean"
+	case "slice":
+		return "list of strings"
+	default:
+		return kind
+	}
+}
+
+func taskFieldsFromForm(form url.Values) (taskFields, fieldErrors) {
+	errs := fieldErrors{}
+	f := taskFields{
+		Title:      form.Get("title"),
+		Details:    form.Get("details"),
+		Recurrence: strings.TrimSpace(form.Get("recurrence")),
+		Priority:   form.Get("priority"),
+	}
+
+	if done := strings.TrimSpace(form.Get("done")); done != "" {
+		v, err := strconv.ParseBool(strings.ToLower(done))
+		if err != nil {
+			errs["done"] = "must be true or false"
+		}
+		f.Done = v
+	}
+
+	if due := strings.TrimSpace(form.Get("due_at")); due != "" {
+		t, err := time.Parse(time.RFC3339, due)
+		if err != nil {
+			errs["due_at"] = "must be an RFC 3339 date-time"
+		} else {
+			f.DueAt = &t
+		}
+	}
+
+	for _, value := range form["tags"] {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				f.Tags = append(f.Tags, tag)
+			}
+		}
+	}
+
+	return f, errs
+}
+
+func uploadTaskImage(file multipart.File) (string, error) {
+	cld, err := cloudinary.NewFromParams(
+		os.Getenv("CLOUDINARY_CLOUD_NAME"),
+		os.Getenv("CLOUDINARY_API_KEY"),
+		os.Getenv("CLOUDINARY_API_SECRET"),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	uploadResp, err := cld.Upload.Upload(context.Background(), file, uploader.UploadParams{})
+	if err != nil {
+		return "", err
+	}
+	return uploadResp.SecureURL, nil
+}
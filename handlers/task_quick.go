@@ -0,0 +1,457 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"task-api/middlewares"
+	"task-api/utils"
+)
+
+const maxQuickAddLength = 1000
+
+// quickPart is a piece of a quick-add line that was read as a field
+// rather than as part of the title.
+type quickPart struct {
+	Text  string `json:"text"`
+	Field string `json:"field"`
+	start int
+}
+
+// quickParse is how a quick-add line was understood: the task fields,
+// the timezone dates and times were read in, and which words set what.
+type quickParse struct {
+	taskFields
+	Timezone string      `json:"timezone"`
+	Parts    []quickPart `json:"parts"`
+}
+
+type quickAddRequest struct {
+	Text string `json:"text"`
+}
+
+// QuickAddTask godoc
+// @Summary      Add a task from one line of text
+// @Description  Reads a line like "Pay rent tomorrow 9am #finance !high every month": #words are tags, !high, !medium or !low (or !1 to !3) the priority, "every ..." the recurrence and dates and times such as today, friday, next week, in 3 days, oct 20, 2026-10-20, 9am or 14:30 the due date, in your timezone. The rest is the title. Returns the task with what was read from where; with dry_run=true nothing is saved.
+// @Tags         tasks
+// @Accept       json,plain
+// @Produce      json
+// @Param        body body quickAddRequest true "The line, or send it as text/plain"
+// @Param        dry_run query boolean false "Parse only"
+// @Success      201 {object} map[string]interface{}
+// @Success      200 {object} map[string]interface{} "Dry run"
+// @Failure      400 {object} utils.Problem "Bad request"
+// @Failure      422 {object} utils.Problem "Invalid fields"
+// @Router       /tasks/quick [post]
+func QuickAddTask(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	var text string
+	body := http.MaxBytesReader(w, r.Body, 64<<10)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var req quickAddRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			utils.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		text = req.Text
+	case "text/plain":
+		data, err := io.ReadAll(body)
+		if err != nil {
+			utils.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		text = string(data)
+	default:
+		utils.Error(w, "Content-Type must be application/json or text/plain", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+		utils.ValidationError(w, "Invalid quick add", fieldErrors{"text": "is required"})
+		return
+	case len([]rune(text)) > maxQuickAddLength, strings.ContainsAny(text, "\r\n"):
+		utils.ValidationError(w, "Invalid quick add", fieldErrors{"text": "must be a single line of at most 1000 characters"})
+		return
+	}
+
+	userID := middlewares.GetUserID(r)
+	parsed := parseQuickAdd(text, time.Now().In(userLocation(userID)))
+	errs := fieldErrors{}
+	parsed.validate(errs)
+
+	w.Header().Set("Content-Type", "application/json")
+	if dryRun {
+		response := map[string]interface{}{"dry_run": true, "parsed": parsed}
+		if len(errs) > 0 {
+			response["errors"] = errs
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+	task, err := createTask(userID, parsed.taskFields)
+	if err != nil {
+		utils.Error(w, "Failed to create task", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", task.ETag)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"task": task, "parsed": parsed})
+}
+
+// quickLine is a quick-add line being taken apart word by word. Words
+// read as a field are marked used; the rest make up the title.
+type quickLine struct {
+	words []string
+	used  []bool
+	parts []quickPart
+}
+
+// word is the i-th word lower-cased and without trailing punctuation,
+// or "" if there is none or it is used.
+func (l *quickLine) word(i int) string {
+	if i < 0 || i >= len(l.words) || l.used[i] {
+		return ""
+	}
+	return strings.ToLower(strings.TrimRight(l.words[i], ",.;"))
+}
+
+// take marks words i to j-1 as field, along with a preposition before
+// them ("on friday", "at 9am").
+func (l *quickLine) take(i, j int, field string, prepositions ...string) {
+	for _, p := range prepositions {
+		if l.word(i-1) == p {
+			i--
+			break
+		}
+	}
+	for k := i; k < j; k++ {
+		l.used[k] = true
+	}
+	l.parts = append(l.parts, quickPart{Text: strings.Join(l.words[i:j], " "), Field: field, start: i})
+}
+
+var quickPriorities = map[string]string{
+	"!high": priorityHigh, "!h": priorityHigh, "!1": priorityHigh, "!!!": priorityHigh,
+	"!medium": priorityMedium, "!med": priorityMedium, "!m": priorityMedium, "!2": priorityMedium, "!!": priorityMedium,
+	"!low": priorityLow, "!l": priorityLow, "!3": priorityLow,
+}
+
+var (
+	weekdays = map[string]time.Weekday{
+		"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+		"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+	}
+	rruleDays = [...]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+	months    = map[string]time.Month{
+		"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April, "may": time.May, "jun": time.June,
+		"jul": time.July, "aug": time.August, "sep": time.September, "oct": time.October,
+		"nov": time.November, "dec": time.December,
+	}
+	quickUnits = map[string]string{"day": "DAILY", "week": "WEEKLY", "month": "MONTHLY", "year": "YEARLY"}
+
+	clockTime  = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?(am|pm)?$`)
+	dayOfMonth = regexp.MustCompile(`^(\d{1,2})(?:st|nd|rd|th)?$`)
+)
+
+// parseQuickAdd reads a quick-add line against now, which carries the
+// user's timezone. Dates without a time are stored as plain dates; a
+// time without a date is today, or tomorrow once it has passed. A
+// recurring task without a date starts on its first occurrence from
+// today.
+func parseQuickAdd(text string, now time.Time) quickParse {
+	words := strings.Fields(text)
+	l := &quickLine{words: words, used: make([]bool, len(words))}
+	p := quickParse{Timezone: now.Location().String()}
+
+	for i, word := range words {
+		switch {
+		case len(word) > 1 && word[0] == '#':
+			p.Tags = append(p.Tags, strings.TrimRight(word[1:], ",.;:!?"))
+			l.take(i, i+1, "tags")
+		case quickPriorities[l.word(i)] != "" && p.Priority == "":
+			p.Priority = quickPriorities[l.word(i)]
+			l.take(i, i+1, "priority")
+		}
+	}
+
+	byDay := quickRecurrence(l, &p)
+	date, hasDate := quickDate(l, now)
+	hour, minute, hasTime := quickTime(l)
+
+	switch {
+	case !hasDate && len(byDay) > 0:
+		date = now
+		for !containsWeekday(byDay, date.Weekday()) {
+			date = date.AddDate(0, 0, 1)
+		}
+		hasDate = true
+	case !hasDate && (hasTime || p.Recurrence != ""):
+		date, hasDate = now, true
+		if hasTime && p.Recurrence == "" && !time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location()).After(now) {
+			date = now.AddDate(0, 0, 1)
+		}
+	}
+	if hasDate {
+		due := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		if hasTime {
+			due = time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, now.Location())
+		}
+		p.DueAt = &due
+	}
+
+	title := []string{}
+	for i, word := range words {
+		if !l.used[i] {
+			title = append(title, word)
+		}
+	}
+	p.Title = strings.TrimRight(strings.Join(title, " "), " ,;:-")
+
+	sort.Slice(l.parts, func(i, j int) bool { return l.parts[i].start < l.parts[j].start })
+	p.Parts = l.parts
+	return p
+}
+
+// quickRecurrence reads "every day", "every weekday", "every other
+// week", "every 3 months", "every monday and thursday" and the like into
+// an RRULE. It returns the weekdays a weekly rule falls on, if any.
+func quickRecurrence(l *quickLine, p *quickParse) []time.Weekday {
+	for i := range l.words {
+		if l.word(i) != "every" {
+			continue
+		}
+
+		j, interval := i+1, 1
+		if l.word(j) == "other" {
+			j, interval = j+1, 2
+		} else if n, err := strconv.Atoi(l.word(j)); err == nil && n > 0 {
+			j, interval = j+1, n
+		}
+
+		rule := ""
+		var days []time.Weekday
+		unit := strings.TrimSuffix(l.word(j), "s")
+		switch {
+		case unit == "weekday" && interval == 1:
+			rule = "FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR"
+			days = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+			j++
+		case quickUnits[unit] != "":
+			rule = "FREQ=" + quickUnits[unit]
+			j++
+		default:
+			for {
+				day, ok := weekdays[strings.TrimSuffix(l.word(j), "s")]
+				if !ok {
+					break
+				}
+				days = append(days, day)
+				j++
+				if w := l.word(j); w == "and" || w == "&" {
+					if _, ok := weekdays[strings.TrimSuffix(l.word(j+1), "s")]; ok {
+						j++
+					}
+				}
+			}
+			if len(days) == 0 {
+				continue
+			}
+			byDay := make([]string, len(days))
+			for k, day := range days {
+				byDay[k] = rruleDays[day]
+			}
+			rule = "FREQ=WEEKLY;BYDAY=" + strings.Join(byDay, ",")
+		}
+
+		if interval > 1 {
+			rule += ";INTERVAL=" + strconv.Itoa(interval)
+		}
+		p.Recurrence = rule
+		l.take(i, j, "recurrence")
+		return days
+	}
+	return nil
+}
+
+func containsWeekday(days []time.Weekday, day time.Weekday) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// quickDate finds the first date in the line: today, tomorrow, a
+// weekday (the next one after today), next week (Monday), next month
+// (the 1st), in N days/weeks/months, an ISO date, or a month and day
+// such as "oct 20" or "20 october" (next year once it has passed).
+func quickDate(l *quickLine, now time.Time) (time.Time, bool) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	prepositions := []string{"on", "by", "due"}
+
+	for i := range l.words {
+		word := l.word(i)
+		switch {
+		case word == "":
+			continue
+		case word == "today":
+			l.take(i, i+1, "due_at", prepositions...)
+			return today, true
+		case word == "tomorrow" || word == "tmrw":
+			l.take(i, i+1, "due_at", prepositions...)
+			return today.AddDate(0, 0, 1), true
+		}
+
+		start := i
+		if word == "next" {
+			switch next := l.word(i + 1); next {
+			case "week":
+				l.take(i, i+2, "due_at", prepositions...)
+				return nextWeekday(today, time.Monday), true
+			case "month":
+				l.take(i, i+2, "due_at", prepositions...)
+				return time.Date(today.Year(), today.Month()+1, 1, 0, 0, 0, 0, now.Location()), true
+			default:
+				i, word = i+1, next
+			}
+		}
+		if day, ok := weekdays[word]; ok {
+			l.take(start, i+1, "due_at", prepositions...)
+			return nextWeekday(today, day), true
+		}
+		if start != i {
+			continue
+		}
+
+		if word == "in" {
+			n, err := strconv.Atoi(l.word(i + 1))
+			if w := l.word(i + 1); w == "a" || w == "an" {
+				n, err = 1, nil
+			}
+			unit := strings.TrimSuffix(l.word(i+2), "s")
+			if err == nil && n > 0 && n <= 1000 && quickUnits[unit] != "" {
+				l.take(i, i+3, "due_at", prepositions...)
+				switch unit {
+				case "day":
+					return today.AddDate(0, 0, n), true
+				case "week":
+					return today.AddDate(0, 0, 7*n), true
+				case "month":
+					return today.AddDate(0, n, 0), true
+				default:
+					return today.AddDate(n, 0, 0), true
+				}
+			}
+		}
+
+		if t, err := time.ParseInLocation(time.DateOnly, word, now.Location()); err == nil {
+			l.take(i, i+1, "due_at", prepositions...)
+			return t, true
+		}
+
+		// "oct 20" or "20 oct"
+		month, day, end := time.Month(0), 0, 0
+		if m, ok := monthOf(word); ok {
+			if match := dayOfMonth.FindStringSubmatch(l.word(i + 1)); match != nil {
+				month, end = m, i+2
+				day, _ = strconv.Atoi(match[1])
+			}
+		} else if match := dayOfMonth.FindStringSubmatch(word); match != nil {
+			if m, ok := monthOf(l.word(i + 1)); ok {
+				month, end = m, i+2
+				day, _ = strconv.Atoi(match[1])
+			}
+		}
+		if month != 0 {
+			t := time.Date(today.Year(), month, day, 0, 0, 0, 0, now.Location())
+			if t.Month() != month || t.Day() != day {
+				continue // e.g. feb 30
+			}
+			if t.Before(today) {
+				t = t.AddDate(1, 0, 0)
+			}
+			l.take(i, end, "due_at", prepositions...)
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// monthOf reads a month name, in full or abbreviated.
+func monthOf(word string) (time.Month, bool) {
+	if len(word) < 3 {
+		return 0, false
+	}
+	m, ok := months[word[:3]]
+	if !ok || (len(word) > 3 && !strings.HasPrefix(strings.ToLower(m.String()), word)) {
+		return 0, false
+	}
+	return m, true
+}
+
+// nextWeekday is the first day after today that falls on day.
+func nextWeekday(today time.Time, day time.Weekday) time.Time {
+	days := (int(day)-int(today.Weekday())+6)%7 + 1
+	return today.AddDate(0, 0, days)
+}
+
+// quickTime finds a time of day: 9am, 9:30pm, "9 am", 14:30 or noon.
+// A bare number is only a time after "at".
+func quickTime(l *quickLine) (hour, minute int, ok bool) {
+	prepositions := []string{"at", "@", "by"}
+	for i := range l.words {
+		word := l.word(i)
+		if word == "noon" {
+			l.take(i, i+1, "due_at", prepositions...)
+			return 12, 0, true
+		}
+
+		end := i + 1
+		if suffix := l.word(i + 1); suffix == "am" || suffix == "pm" {
+			word, end = word+suffix, i+2
+		}
+		match := clockTime.FindStringSubmatch(word)
+		if match == nil || (match[2] == "" && match[3] == "" && l.word(i-1) != "at" && l.word(i-1) != "@") {
+			continue
+		}
+
+		hour, _ = strconv.Atoi(match[1])
+		minute, _ = strconv.Atoi(match[2])
+		switch {
+		case minute > 59:
+			continue
+		case match[3] == "":
+			if hour > 23 {
+				continue
+			}
+		case hour < 1 || hour > 12:
+			continue
+		case match[3] == "pm" && hour != 12:
+			hour += 12
+		case match[3] == "am" && hour == 12:
+			hour = 0
+		}
+		l.take(i, end, "due_at", prepositions...)
+		return hour, minute, true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+const tokenColumns = "id, user_id, name, scopes, expires_at, last_used_at, created_at, revoked_at"
+
+func scanTokens(w http.ResponseWriter, query string, args ...interface{}) {
+	rows, err := db.Pool.Query(context.Background(), query, args...)
+	if err != nil {
+		utils.Error(w, "Failed to fetch tokens", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []models.PersonalAccessToken{}
+	for rows.Next() {
+		var t models.PersonalAccessToken
+		err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Scopes, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt, &t.RevokedAt)
+		if err != nil {
+			utils.Error(w, "Failed to parse token", http.StatusInternalServerError)
+			return
+		}
+		tokens = append(tokens, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreatePersonalToken returns the raw token exactly once; only its hash
+// is stored.
+func CreatePersonalToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name          string     `json:"name"`
+		Scopes        []string   `json:"scopes"`
+		ExpiresAt     *time.Time `json:"expires_at"`
+		ExpiresInDays int        `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		utils.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(body.Scopes) == 0 {
+		utils.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range body.Scopes {
+		if !slices.Contains(middlewares.ValidScopes, scope) {
+			utils.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if slices.Contains(body.Scopes, middlewares.ScopeAdmin) {
+		if middlewares.GetUserRole(r) != "admin" {
+			utils.Error(w, "Only admins can create admin:* tokens", http.StatusForbidden)
+			return
+		}
+		if middlewares.AdminRequires2FA() && !middlewares.SessionHasMFA(r) {
+			utils.Error(w, "Two-factor authentication is required for admin:* tokens", http.StatusForbidden)
+			return
+		}
+	}
+
+	expiresAt := body.ExpiresAt
+	if expiresAt == nil && body.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, body.ExpiresInDays)
+		expiresAt = &t
+	}
+	if expiresAt != nil && expiresAt.Before(time.Now()) {
+		utils.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	raw, _, err := utils.GenerateToken()
+	if err != nil {
+		utils.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	raw = utils.PersonalTokenPrefix + raw
+
+	var t models.PersonalAccessToken
+	err = db.Pool.QueryRow(context.Background(),
+		`INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, expires_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING `+tokenColumns,
+		middlewares.GetUserID(r), body.Name, utils.HashToken(raw), body.Scopes, expiresAt,
+	).Scan(&t.ID, &t.UserID, &t.Name, &t.Scopes, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt, &t.RevokedAt)
+	if err != nil {
+		utils.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	audit(r, t.UserID, AuditTokenCreated, "personal_access_token", t.ID.String(), nil, map[string]interface{}{
+		"name":       t.Name,
+		"scopes":     t.Scopes,
+		"expires_at": t.ExpiresAt,
+	})
+
+	t.Token = raw
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+func GetPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	scanTokens(w,
+		"SELECT "+tokenColumns+" FROM personal_access_tokens WHERE user_id=$1 AND revoked_at IS NULL ORDER BY created_at DESC",
+		middlewares.GetUserID(r),
+	)
+}
+
+func RevokePersonalToken(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	commandTag, err := db.Pool.Exec(context.Background(),
+		"UPDATE personal_access_tokens SET revoked_at=now() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL",
+		id, middlewares.GetUserID(r),
+	)
+	if err != nil || commandTag.RowsAffected() == 0 {
+		utils.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	audit(r, middlewares.GetUserID(r), AuditTokenRevoked, "personal_access_token", id.String(), nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetAllPersonalTokens lets admins audit tokens, optionally for one user.
+func GetAllPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + tokenColumns + " FROM personal_access_tokens WHERE revoked_at IS NULL"
+	args := []interface{}{}
+
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		id, err := uuid.Parse(userID)
+		if err != nil {
+			utils.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		query += " AND user_id=$1"
+		args = append(args, id)
+	}
+
+	scanTokens(w, query+" ORDER BY created_at DESC", args...)
+}
+
+func AdminRevokePersonalToken(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	commandTag, err := db.Pool.Exec(context.Background(),
+		"UPDATE personal_access_tokens SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL", id)
+	if err != nil || commandTag.RowsAffected() == 0 {
+		utils.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	audit(r, middlewares.GetUserID(r), AuditTokenRevoked, "personal_access_token", id.String(), nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
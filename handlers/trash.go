@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+// trashRetention is how long a deleted task stays restorable before
+// PurgeTrash removes it for good.
+func trashRetention() time.Duration {
+	return envDuration("TRASH_RETENTION", 30*24*time.Hour)
+}
+
+// GetTrash lists the caller's deleted tasks, newest first. Admins see
+// every user's trash, as with GetTasks.
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + taskColumns + `, deleted_at
+	FROM tasks WHERE deleted_at IS NOT NULL AND user_id IS NOT NULL`
+	args := []interface{}{}
+	if middlewares.GetUserRole(r) != "admin" {
+		query += " AND user_id=$1"
+		args = append(args, middlewares.GetUserID(r))
+	}
+	query += " ORDER BY deleted_at DESC"
+
+	rows, err := db.Pool.Query(context.Background(), query, args...)
+	if err != nil {
+		utils.Error(w, "Failed to fetch trash", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tasks := []models.Task{}
+	for rows.Next() {
+		var task models.Task
+		err := scanTask(rows, &task, &task.DeletedAt)
+		if err != nil {
+			utils.Error(w, "Failed to parse task", http.StatusInternalServerError)
+			return
+		}
+		tasks = append(tasks, task)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tasks)
+}
+
+// RestoreTask takes a task out of the trash.
+func RestoreTask(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid Task ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := middlewares.GetUserID(r)
+	isAdmin := middlewares.GetUserRole(r) == "admin"
+
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Failed to restore task", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var task models.Task
+	err = scanTask(tx.QueryRow(ctx,
+		`UPDATE tasks SET deleted_at=NULL, deleted_by=NULL, version=version+1
+		 WHERE id=$1 AND deleted_at IS NOT NULL AND user_id IS NOT NULL AND ($2 OR user_id=$3)
+		 RETURNING `+taskColumns,
+		id, isAdmin, userID,
+	), &task)
+	if err != nil {
+		utils.Error(w, "Task not found in trash", http.StatusNotFound)
+		return
+	}
+
+	err = recordRevision(ctx, tx, userID, RevisionRestored, &task, task)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		utils.Error(w, "Failed to restore task", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, userID, AuditTaskRestored, "task", id.String(), nil, task)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", task.ETag)
+	json.NewEncoder(w).Encode(task)
+}
+
+// PurgeTask permanently deletes one task from the trash. Admins can also
+// purge tasks archived when their owner was deleted.
+func PurgeTask(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid Task ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := middlewares.GetUserID(r)
+	isAdmin := middlewares.GetUserRole(r) == "admin"
+
+	var purged struct {
+		ID       uuid.UUID  `json:"id"`
+		Title    string     `json:"title"`
+		Details  string     `json:"details"`
+		Done     bool       `json:"done"`
+		ImageURL string     `json:"image_url"`
+		UserID   *uuid.UUID `json:"user_id"`
+	}
+	var syncSeq int64
+	err = db.Pool.QueryRow(context.Background(),
+		`DELETE FROM tasks
+		 WHERE id=$1 AND ((deleted_at IS NOT NULL AND ($2 OR user_id=$3)) OR ($2 AND archived_at IS NOT NULL))
+		 RETURNING id, title, details, done, image_url, user_id, sync_seq`,
+		id, isAdmin, userID,
+	).Scan(&purged.ID, &purged.Title, &purged.Details, &purged.Done, &purged.ImageURL, &purged.UserID, &syncSeq)
+	if err != nil {
+		utils.Error(w, "Task not found in trash", http.StatusNotFound)
+		return
+	}
+
+	if purged.UserID != nil {
+		if err := raiseSyncFloor(*purged.UserID, syncSeq); err != nil {
+			log.Printf("PurgeTask sync floor error: %v", err)
+		}
+	}
+
+	audit(r, userID, AuditTaskPurged, "task", id.String(), purged, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EmptyTrash permanently deletes all of the caller's trashed tasks.
+func EmptyTrash(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	rows, err := db.Pool.Query(context.Background(),
+		"DELETE FROM tasks WHERE user_id=$1 AND deleted_at IS NOT NULL RETURNING id, sync_seq", userID)
+	if err != nil {
+		utils.Error(w, "Failed to empty trash", http.StatusInternalServerError)
+		return
+	}
+	type purgedTask struct {
+		ID      uuid.UUID
+		SyncSeq int64
+	}
+	purged, err := pgx.CollectRows(rows, pgx.RowToStructByPos[purgedTask])
+	if err != nil {
+		utils.Error(w, "Failed to empty trash", http.StatusInternalServerError)
+		return
+	}
+
+	var maxSeq int64
+	for _, task := range purged {
+		audit(r, userID, AuditTaskPurged, "task", task.ID.String(), nil, nil)
+		maxSeq = max(maxSeq, task.SyncSeq)
+	}
+	if err := raiseSyncFloor(userID, maxSeq); err != nil {
+		log.Printf("EmptyTrash sync floor error: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": len(purged)})
+}
+
+// PurgeTrash removes tasks that have been in the trash longer than the
+// retention period, raising their owners' sync floors like PurgeTask. It
+// runs on a schedule from main.
+func PurgeTrash() error {
+	var n int
+	err := db.Pool.QueryRow(context.Background(),
+		`WITH purged AS (
+		   DELETE FROM tasks WHERE deleted_at < $1 RETURNING user_id, sync_seq
+		 ), floors AS (
+		   UPDATE users u SET dav_sync_floor=GREATEST(u.dav_sync_floor, p.sync_seq)
+		   FROM (SELECT user_id, max(sync_seq) AS sync_seq FROM purged GROUP BY user_id) p
+		   WHERE u.id = p.user_id
+		 )
+		 SELECT count(*) FROM purged`,
+		time.Now().Add(-trashRetention()),
+	).Scan(&n)
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		log.Printf("Purged %d tasks from the trash", n)
+	}
+	return nil
+}
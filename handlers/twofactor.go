@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/skip2/go-qrcode"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+const (
+	mfaChallengePurpose = "mfa_challenge"
+	mfaChallengeTTL     = 5 * time.Minute
+	recoveryCodeCount   = 10
+)
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Task Manager API"
+}
+
+// Enroll2FA starts (or restarts) enrollment. The secret is stored but
+// not enforced until Confirm2FA proves the user's app produces codes.
+func Enroll2FA(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	var email string
+	var enabled bool
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT email, totp_enabled FROM users WHERE id=$1", userID,
+	).Scan(&email, &enabled)
+	if err != nil {
+		utils.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if enabled {
+		utils.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		utils.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Pool.Exec(context.Background(),
+		"UPDATE users SET totp_secret=$1, totp_last_step=0 WHERE id=$2", secret, userID)
+	if err != nil {
+		utils.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	uri := utils.OTPAuthURL(totpIssuer(), email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		utils.Error(w, "Failed to render QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": uri,
+		"qr_png":      base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// Confirm2FA turns 2FA on and returns the recovery codes. They are only
+// ever shown here.
+func Confirm2FA(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var secret *string
+	var enabled bool
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT totp_secret, totp_enabled FROM users WHERE id=$1", userID,
+	).Scan(&secret, &enabled)
+	if err != nil {
+		utils.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if enabled {
+		utils.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if secret == nil {
+		utils.Error(w, "Start enrollment first", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := utils.ValidateTOTP(*secret, body.Code, time.Now(), 0)
+	if !ok {
+		utils.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		utils.Error(w, "Failed to enable 2FA", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		"UPDATE users SET totp_enabled=TRUE, totp_last_step=$1 WHERE id=$2", step, userID)
+	if err != nil {
+		utils.Error(w, "Failed to enable 2FA", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		utils.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		utils.Error(w, "Failed to enable 2FA", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// Disable2FA requires a current code (or recovery code) so a stolen
+// session alone can't switch it off.
+func Disable2FA(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	var body struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !checkSecondFactor(userID, body.Code, body.RecoveryCode) {
+		utils.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	_, err := db.Pool.Exec(context.Background(),
+		"UPDATE users SET totp_enabled=FALSE, totp_secret=NULL, totp_last_step=0 WHERE id=$1", userID)
+	if err != nil {
+		utils.Error(w, "Failed to disable 2FA", http.StatusInternalServerError)
+		return
+	}
+	_, _ = db.Pool.Exec(context.Background(), "DELETE FROM mfa_recovery_codes WHERE user_id=$1", userID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func replaceRecoveryCodes(ctx context.Context, q db.Querier, userID uuid.UUID) ([]string, error) {
+	if _, err := q.Exec(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id=$1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := utils.GenerateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = q.Exec(ctx,
+			"INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, utils.HashToken(code),
+		)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery
+// code, consuming whichever one matched.
+func checkSecondFactor(userID uuid.UUID, code, recoveryCode string) bool {
+	ctx := context.Background()
+
+	if recoveryCode != "" {
+		tag, err := db.Pool.Exec(ctx,
+			"UPDATE mfa_recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL",
+			userID, utils.HashToken(strings.ToLower(strings.TrimSpace(recoveryCode))),
+		)
+		return err == nil && tag.RowsAffected() == 1
+	}
+
+	var secret *string
+	var lastStep int64
+	err := db.Pool.QueryRow(ctx,
+		"SELECT totp_secret, totp_last_step FROM users WHERE id=$1 AND totp_enabled", userID,
+	).Scan(&secret, &lastStep)
+	if err != nil || secret == nil {
+		return false
+	}
+
+	step, ok := utils.ValidateTOTP(*secret, code, time.Now(), lastStep)
+	if !ok {
+		return false
+	}
+
+	// Guard against the same code being used twice concurrently
+	tag, err := db.Pool.Exec(ctx,
+		"UPDATE users SET totp_last_step=$1 WHERE id=$2 AND totp_last_step < $1", step, userID)
+	return err == nil && tag.RowsAffected() == 1
+}
+
+// mfaChallenge is what Login returns instead of a token when the account
+// has 2FA enabled.
+func mfaChallenge(w http.ResponseWriter, user models.User) {
+	challenge, err := signPurposeToken(mfaChallengePurpose, jwt.MapClaims{
+		"user_id": user.ID.String(),
+	}, mfaChallengeTTL)
+	if err != nil {
+		utils.Error(w, "Token error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mfa_required":    true,
+		"challenge_token": challenge,
+	})
+}
+
+// LoginMFA completes the second step of a 2FA login.
+func LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := parsePurposeToken(body.ChallengeToken, mfaChallengePurpose)
+	if err != nil {
+		utils.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	userIDStr, _ := claims["user_id"].(string)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		utils.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	if wait, _ := accountRetryAfter(userID); wait > 0 {
+		tooManyRequests(w, wait, "Too many failed login attempts, try again later")
+		return
+	}
+
+	if !checkSecondFactor(userID, body.Code, body.RecoveryCode) {
+		recordLoginFailure(userID, clientIP(r))
+		audit(r, uuid.Nil, AuditLoginFailed, "user", userID.String(), nil, map[string]string{"reason": "second_factor"})
+		utils.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	var user models.User
+	err = db.Pool.QueryRow(context.Background(),
+		"SELECT id, role, banned FROM users WHERE id=$1", userID,
+	).Scan(&user.ID, &user.Role, &user.Banned)
+	if err != nil {
+		utils.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	if user.Banned {
+		writeBanned(w, user.ID)
+		return
+	}
+
+	resetLoginFailures(user.ID)
+	issueToken(w, r, user, true)
+}
@@ -7,20 +7,22 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"task-api/utils"
 )
 
 func UploadImage(w http.ResponseWriter, r *http.Request) {
 	// Parse up to 10MB file
 	err := r.ParseMultipartForm(10 << 20) // 10MB
 	if err != nil {
-		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		utils.Error(w, "Unable to parse form", http.StatusBadRequest)
 		return
 	}
 
 	// Get file from form
 	file, handler, err := r.FormFile("image")
 	if err != nil {
-		http.Error(w, "Image not provided", http.StatusBadRequest)
+		utils.Error(w, "Image not provided", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
@@ -35,7 +37,7 @@ func UploadImage(w http.ResponseWriter, r *http.Request) {
 	// Create file on disk
 	dst, err := os.Create(filepath)
 	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		utils.Error(w, "Failed to save file", http.StatusInternalServerError)
 		return
 	}
 	defer dst.Close()
@@ -43,7 +45,7 @@ func UploadImage(w http.ResponseWriter, r *http.Request) {
 	// Copy file data to destination
 	_, err = io.Copy(dst, file)
 	if err != nil {
-		http.Error(w, "Failed to write file", http.StatusInternalServerError)
+		utils.Error(w, "Failed to write file", http.StatusInternalServerError)
 		return
 	}
 
@@ -3,25 +3,28 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	// "yourproject/utils" // Adjust this import to your project structure
 
 	"github.com/cloudinary/cloudinary-go/v2"
 	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
+
+	"task-api/utils"
 )
 
 func UploadToCloudinary(w http.ResponseWriter, r *http.Request) {
 	// Parse file
 	err := r.ParseMultipartForm(10 << 20)
 	if err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		utils.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 
 	file, _, err := r.FormFile("image")
 	if err != nil {
-		http.Error(w, "Image not provided", http.StatusBadRequest)
+		utils.Error(w, "Image not provided", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
@@ -33,14 +36,15 @@ func UploadToCloudinary(w http.ResponseWriter, r *http.Request) {
 		os.Getenv("CLOUDINARY_API_SECRET"),
 	)
 	if err != nil {
-		http.Error(w, "Cloudinary init error", http.StatusInternalServerError)
+		utils.Error(w, "Cloudinary init error", http.StatusInternalServerError)
 		return
 	}
 
 	// Upload to Cloudinary
 	uploadResp, err := cld.Upload.Upload(context.Background(), file, uploader.UploadParams{})
 	if err != nil {
-		http.Error(w, "Upload failed: "+err.Error(), http.StatusInternalServerError)
+		log.Printf("UploadToCloudinary error: %v", err)
+		utils.Error(w, "Upload failed", http.StatusInternalServerError)
 		return
 	}
 
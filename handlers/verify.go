@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/utils"
+)
+
+const verifyEmailPurpose = "verify_email"
+
+func verificationTTL() time.Duration {
+	return envDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+}
+
+// resendInterval throttles how often a user can ask for another email.
+func resendInterval() time.Duration {
+	return envDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute)
+}
+
+// sendVerificationEmail mails a signed link bound to both the user and
+// the address, so the link stops working if the email changes.
+func sendVerificationEmail(userID uuid.UUID, email string) error {
+	link, err := verificationLink(userID, email)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Pool.Exec(context.Background(),
+		"UPDATE users SET verification_sent_at=now() WHERE id=$1", userID)
+	if err != nil {
+		return err
+	}
+
+	go utils.SendEmail(email, "Verify your email address", fmt.Sprintf(
+		"Welcome! Please confirm your email address by opening this link:\n\n%s", link,
+	))
+
+	return nil
+}
+
+func verificationLink(userID uuid.UUID, email string) (string, error) {
+	token, err := signPurposeToken(verifyEmailPurpose, jwt.MapClaims{
+		"user_id": userID.String(),
+		"email":   email,
+	}, verificationTTL())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/verify-email?token=%s", appURL(), url.QueryEscape(token)), nil
+}
+
+// sendEmailChangeLink mails the confirmation for a pending email change
+// to the new address. The link is the same kind as sendVerificationEmail
+// sends; VerifyEmail tells them apart by the address in it.
+func sendEmailChangeLink(userID uuid.UUID, email string) error {
+	link, err := verificationLink(userID, email)
+	if err != nil {
+		return err
+	}
+
+	go utils.SendEmail(email, "Confirm your new email address", fmt.Sprintf(
+		"Open this link to start signing in with this address:\n\n%s", link,
+	))
+	return nil
+}
+
+// VerifyEmail confirms either the account's current address or, if the
+// link was sent to a pending new address, swaps that in.
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	claims, err := parsePurposeToken(r.URL.Query().Get("token"), verifyEmailPurpose)
+	if err != nil {
+		utils.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := claims["user_id"].(string)
+	email, _ := claims["email"].(string)
+
+	var oldEmail string
+	err = db.Pool.QueryRow(context.Background(),
+		`UPDATE users u SET email=u.pending_email, pending_email=NULL, email_verified=TRUE
+		 FROM (SELECT email FROM users WHERE id=$1) prev
+		 WHERE u.id=$1 AND u.pending_email=$2
+		 RETURNING prev.email`, userID, email,
+	).Scan(&oldEmail)
+	switch {
+	case err == nil:
+		go utils.SendEmail(oldEmail, "Your email address was changed",
+			fmt.Sprintf("The email on your account was changed to %s. If this wasn't you, contact support.", email))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Email changed"})
+		return
+	case strings.Contains(err.Error(), "duplicate key value"):
+		utils.ErrorCode(w, "Email already registered", http.StatusConflict, "email_taken")
+		return
+	case !errors.Is(err, pgx.ErrNoRows):
+		utils.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+		return
+	}
+
+	commandTag, err := db.Pool.Exec(context.Background(),
+		"UPDATE users SET email_verified=TRUE WHERE id=$1 AND email=$2", userID, email)
+	if err != nil || commandTag.RowsAffected() == 0 {
+		utils.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified"})
+}
+
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	var email string
+	var verified bool
+	var sentAt *time.Time
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT email, email_verified, verification_sent_at FROM users WHERE id=$1", userID,
+	).Scan(&email, &verified, &sentAt)
+	if err != nil {
+		utils.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if verified {
+		utils.Error(w, "Email already verified", http.StatusConflict)
+		return
+	}
+
+	if sentAt != nil {
+		if wait := time.Until(sentAt.Add(resendInterval())); wait > 0 {
+			tooManyRequests(w, wait, "Verification email sent recently, try again later")
+			return
+		}
+	}
+
+	if err := sendVerificationEmail(userID, email); err != nil {
+		utils.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"task-api/db"
+	"task-api/middlewares"
+	"task-api/models"
+	"task-api/utils"
+)
+
+const (
+	webauthnCreate = "webauthn.create"
+	webauthnGet    = "webauthn.get"
+	webauthnTTL    = 5 * time.Minute
+)
+
+// webauthnRPID defaults to the host part of APP_URL.
+func webauthnRPID() string {
+	if id := os.Getenv("WEBAUTHN_RP_ID"); id != "" {
+		return id
+	}
+	u, err := url.Parse(appURL())
+	if err != nil {
+		return "localhost"
+	}
+	return u.Hostname()
+}
+
+func webauthnOrigin() string {
+	if origin := os.Getenv("WEBAUTHN_ORIGIN"); origin != "" {
+		return strings.TrimRight(origin, "/")
+	}
+	return appURL()
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// webauthnCredential is the PublicKeyCredential a browser returns, with
+// binary fields base64url-encoded.
+type webauthnCredential struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+func newWebAuthnChallenge(ceremony string, userID *uuid.UUID) (uuid.UUID, []byte, error) {
+	raw, _, err := utils.GenerateToken()
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	challenge, _ := utils.DecodeBase64URL(raw)
+
+	var id uuid.UUID
+	err = db.Pool.QueryRow(context.Background(),
+		`INSERT INTO webauthn_challenges (user_id, challenge, ceremony, expires_at)
+		 VALUES ($1, $2, $3, $4) RETURNING id`,
+		userID, challenge, ceremony, time.Now().Add(webauthnTTL),
+	).Scan(&id)
+
+	return id, challenge, err
+}
+
+// consumeWebAuthnChallenge deletes the challenge as it reads it so each
+// one can be answered at most once.
+func consumeWebAuthnChallenge(id, ceremony string) ([]byte, *uuid.UUID, error) {
+	var challenge []byte
+	var userID *uuid.UUID
+	err := db.Pool.QueryRow(context.Background(),
+		`DELETE FROM webauthn_challenges
+		 WHERE id=$1 AND ceremony=$2 AND expires_at > now()
+		 RETURNING challenge, user_id`,
+		id, ceremony,
+	).Scan(&challenge, &userID)
+
+	return challenge, userID, err
+}
+
+func credentialDescriptors(userID uuid.UUID) []map[string]string {
+	list := []map[string]string{}
+
+	rows, err := db.Pool.Query(context.Background(),
+		"SELECT credential_id FROM webauthn_credentials WHERE user_id=$1", userID)
+	if err != nil {
+		return list
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id []byte
+		if rows.Scan(&id) == nil {
+			list = append(list, map[string]string{"type": "public-key", "id": b64url(id)})
+		}
+	}
+	return list
+}
+
+// fakeCredentialDescriptors stands in for an email with no passkeys, so
+// that BeginPasskeyLogin answers the same whether or not the account
+// exists. The id is derived from the email, so asking twice gives the
+// same answer.
+func fakeCredentialDescriptors(email string) []map[string]string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	mac.Write([]byte("webauthn-fake-credential:" + email))
+	return []map[string]string{{"type": "public-key", "id": b64url(mac.Sum(nil)[:16])}}
+}
+
+// BeginPasskeyRegistration returns PublicKeyCredentialCreationOptions for
+// navigator.credentials.create().
+func BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID := middlewares.GetUserID(r)
+
+	var name, email string
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT name, email FROM users WHERE id=$1", userID,
+	).Scan(&name, &email)
+	if err != nil {
+		utils.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	challengeID, challenge, err := newWebAuthnChallenge(webauthnCreate, &userID)
+	if err != nil {
+		utils.Error(w, "Failed to create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"challenge_id": challengeID,
+		"publicKey": map[string]interface{}{
+			"rp":        map[string]string{"id": webauthnRPID(), "name": totpIssuer()},
+			"user":      map[string]string{"id": b64url(userID[:]), "name": email, "displayName": name},
+			"challenge": b64url(challenge),
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": utils.COSEAlgES256},
+				{"type": "public-key", "alg": utils.COSEAlgEdDSA},
+				{"type": "public-key", "alg": utils.COSEAlgRS256},
+			},
+			"timeout":            webauthnTTL.Milliseconds(),
+			"attestation":        "none",
+			"excludeCredentials": credentialDescriptors(userID),
+			"authenticatorSelection": map[string]interface{}{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+		},
+	})
+}
+
+func FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ChallengeID string             `json:"challenge_id"`
+		Name        string             `json:"name"`
+		Credential  webauthnCredential `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID := middlewares.GetUserID(r)
+	challenge, owner, err := consumeWebAuthnChallenge(body.ChallengeID, webauthnCreate)
+	if err != nil || owner == nil || *owner != userID {
+		utils.Error(w, "Invalid or expired challenge", http.StatusBadRequest)
+		return
+	}
+
+	clientDataJSON, err1 := utils.DecodeBase64URL(body.Credential.Response.ClientDataJSON)
+	attestation, err2 := utils.DecodeBase64URL(body.Credential.Response.AttestationObject)
+	if err1 != nil || err2 != nil {
+		utils.Error(w, "Malformed credential", http.StatusBadRequest)
+		return
+	}
+
+	clientDataHash, err := utils.VerifyClientData(clientDataJSON, webauthnCreate, challenge, webauthnOrigin())
+	if err != nil {
+		utils.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	auth, format, err := utils.VerifyAttestation(attestation, clientDataHash)
+	if err == nil {
+		err = utils.CheckRelyingParty(auth, webauthnRPID())
+	}
+	if err == nil {
+		_, _, err = utils.ParseCOSEKey(auth.PublicKey)
+	}
+	if err != nil {
+		utils.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	var cred models.Passkey
+	err = db.Pool.QueryRow(context.Background(),
+		`INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name, aaguid, attestation_format)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 RETURNING id, name, created_at, last_used_at`,
+		userID, auth.CredentialID, auth.PublicKey, int64(auth.SignCount), name, auth.AAGUID, format,
+	).Scan(&cred.ID, &cred.Name, &cred.CreatedAt, &cred.LastUsedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key value") {
+			utils.Error(w, "Passkey already registered", http.StatusConflict)
+			return
+		}
+		utils.Error(w, "Failed to save passkey", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cred)
+}
+
+// BeginPasskeyLogin returns PublicKeyCredentialRequestOptions. The email
+// is optional: without it the browser offers discoverable passkeys.
+func BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			utils.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var userID *uuid.UUID
+	allow := []map[string]string{}
+	if email := strings.ToLower(strings.TrimSpace(body.Email)); email != "" {
+		var id uuid.UUID
+		err := db.Pool.QueryRow(context.Background(), "SELECT id FROM users WHERE email=$1", email).Scan(&id)
+		if err == nil {
+			userID = &id
+			allow = credentialDescriptors(id)
+		}
+		if len(allow) == 0 {
+			allow = fakeCredentialDescriptors(email)
+		}
+	}
+
+	challengeID, challenge, err := newWebAuthnChallenge(webauthnGet, userID)
+	if err != nil {
+		utils.Error(w, "Failed to create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"challenge_id": challengeID,
+		"publicKey": map[string]interface{}{
+			"challenge":        b64url(challenge),
+			"rpId":             webauthnRPID(),
+			"timeout":          webauthnTTL.Milliseconds(),
+			"allowCredentials": allow,
+			"userVerification": "preferred",
+		},
+	})
+}
+
+// FinishPasskeyLogin is the passkey alternative to the bcrypt check in
+// Login. Sessions count as multi-factor when the authenticator verified
+// the user (PIN or biometric).
+func FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ChallengeID string             `json:"challenge_id"`
+		Credential  webauthnCredential `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		utils.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	challenge, expectedUser, err := consumeWebAuthnChallenge(body.ChallengeID, webauthnGet)
+	if err != nil {
+		utils.Error(w, "Invalid or expired challenge", http.StatusBadRequest)
+		return
+	}
+
+	rawID, err1 := utils.DecodeBase64URL(body.Credential.RawID)
+	clientDataJSON, err2 := utils.DecodeBase64URL(body.Credential.Response.ClientDataJSON)
+	authData, err3 := utils.DecodeBase64URL(body.Credential.Response.AuthenticatorData)
+	signature, err4 := utils.DecodeBase64URL(body.Credential.Response.Signature)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		utils.Error(w, "Malformed credential", http.StatusBadRequest)
+		return
+	}
+
+	var credID uuid.UUID
+	var publicKey []byte
+	var storedCount int64
+	var user models.User
+	err = db.Pool.QueryRow(context.Background(),
+		`SELECT c.id, c.public_key, c.sign_count, u.id, u.role, u.banned, u.email_verified, u.totp_enabled
+		 FROM webauthn_credentials c JOIN users u ON u.id = c.user_id
+		 WHERE c.credential_id=$1`,
+		rawID,
+	).Scan(&credID, &publicKey, &storedCount, &user.ID, &user.Role, &user.Banned, &user.EmailVerified, &user.TOTPEnabled)
+	if err != nil {
+		utils.Error(w, "Unknown passkey", http.StatusUnauthorized)
+		return
+	}
+
+	if expectedUser != nil && *expectedUser != user.ID {
+		utils.Error(w, "Passkey does not belong to this account", http.StatusUnauthorized)
+		return
+	}
+	if h := body.Credential.Response.UserHandle; h != "" {
+		handle, err := utils.DecodeBase64URL(h)
+		if err != nil || string(handle) != string(user.ID[:]) {
+			utils.Error(w, "Passkey does not belong to this account", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	clientDataHash, err := utils.VerifyClientData(clientDataJSON, webauthnGet, challenge, webauthnOrigin())
+	if err != nil {
+		utils.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	auth, err := utils.ParseAuthenticatorData(authData)
+	if err == nil {
+		err = utils.CheckRelyingParty(auth, webauthnRPID())
+	}
+	if err != nil {
+		utils.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	key, alg, err := utils.ParseCOSEKey(publicKey)
+	if err == nil {
+		err = utils.VerifySignature(key, alg, append(authData, clientDataHash...), signature)
+	}
+	if err != nil {
+		utils.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// A counter that doesn't move forward suggests a cloned authenticator.
+	// Authenticators that don't implement counters always send 0.
+	newCount := int64(auth.SignCount)
+	if (newCount != 0 || storedCount != 0) && newCount <= storedCount {
+		utils.Error(w, "Passkey signature counter did not increase; it may have been cloned", http.StatusUnauthorized)
+		return
+	}
+
+	// Compare-and-swap, so two logins racing with the same counter value
+	// can't both succeed
+	tag, err := db.Pool.Exec(context.Background(),
+		"UPDATE webauthn_credentials SET sign_count=$1, last_used_at=now() WHERE id=$2 AND sign_count=$3",
+		newCount, credID, storedCount)
+	if err != nil {
+		utils.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		utils.Error(w, "Passkey was used by another login at the same time; please try again", http.StatusUnauthorized)
+		return
+	}
+
+	if user.Banned {
+		writeBanned(w, user.ID)
+		return
+	}
+
+	// The passkey stands in for the password: lockout and the
+	// unverified-email policy still apply, as with any other login
+	if wait, locked := accountRetryAfter(user.ID); wait > 0 {
+		msg := "Too many failed login attempts, try again later"
+		if locked {
+			msg = "Account temporarily locked after too many failed login attempts"
+		}
+		tooManyRequests(w, wait, msg)
+		return
+	}
+
+	if !user.EmailVerified && middlewares.UnverifiedPolicy() == middlewares.UnverifiedBlock {
+		utils.ErrorCode(w, "Please verify your email address before logging in", http.StatusForbidden, "email_unverified")
+		return
+	}
+
+	// Only a passkey that verified the user counts as a second factor
+	if user.TOTPEnabled && !auth.UserVerified() {
+		mfaChallenge(w, user)
+		return
+	}
+
+	resetLoginFailures(user.ID)
+	issueToken(w, r, user, auth.UserVerified())
+}
+
+func GetPasskeys(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Pool.Query(context.Background(),
+		"SELECT id, name, created_at, last_used_at FROM webauthn_credentials WHERE user_id=$1 ORDER BY created_at",
+		middlewares.GetUserID(r),
+	)
+	if err != nil {
+		utils.Error(w, "Failed to fetch passkeys", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	passkeys := []models.Passkey{}
+	for rows.Next() {
+		var p models.Passkey
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			utils.Error(w, "Failed to parse passkey", http.StatusInternalServerError)
+			return
+		}
+		passkeys = append(passkeys, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+func DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Error(w, "Invalid passkey ID", http.StatusBadRequest)
+		return
+	}
+
+	commandTag, err := db.Pool.Exec(context.Background(),
+		"DELETE FROM webauthn_credentials WHERE id=$1 AND user_id=$2", id, middlewares.GetUserID(r))
+	if err != nil || commandTag.RowsAffected() == 0 {
+		utils.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
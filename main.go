@@ -10,11 +10,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"task-api/db"
 	_ "task-api/docs"
 	"task-api/handlers"
 	"task-api/middlewares"
+	"task-api/utils"
 
 	gorillaHandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -39,7 +41,20 @@ func main() {
 	db.Connect()
 	defer db.Pool.Close()
 
+	// background jobs
+	go utils.RunEvery(time.Hour, "PurgeDeletedAccounts", handlers.PurgeDeletedAccounts)
+	go utils.RunEvery(time.Hour, "PurgeExpiredExports", handlers.PurgeExpiredExports)
+	go utils.RunEvery(time.Minute, "LiftExpiredBans", handlers.LiftExpiredBans)
+	go utils.RunEvery(time.Hour, "PurgeTrash", handlers.PurgeTrash)
+	go utils.RunEvery(time.Hour, "PurgeExpiredIdempotencyKeys", middlewares.PurgeExpiredIdempotencyKeys)
+
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.Error(w, "No route matches "+r.URL.Path, http.StatusNotFound)
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.Error(w, r.Method+" is not allowed on "+r.URL.Path, http.StatusMethodNotAllowed)
+	})
 
 	r.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
 
@@ -47,16 +62,70 @@ func main() {
 
 	// auth handlers
 	r.HandleFunc("/login", handlers.Login).Methods("POST")
-	r.HandleFunc("/signup", handlers.Signup).Methods("POST")
-	r.HandleFunc("/refresh", middlewares.RequireAuth(handlers.RefreshToken)).Methods("POST")
+	r.HandleFunc("/login/2fa", handlers.LoginMFA).Methods("POST")
+	r.HandleFunc("/login/magic", handlers.RequestMagicLink).Methods("POST")
+	r.HandleFunc("/login/magic/callback", handlers.MagicLinkCallback).Methods("GET")
+	r.HandleFunc("/login/oidc", handlers.OIDCLogin).Methods("GET")
+	r.HandleFunc("/login/oidc/callback", handlers.OIDCCallback).Methods("GET")
+	r.HandleFunc("/signup", middlewares.Idempotent(handlers.Signup)).Methods("POST")
+	r.HandleFunc("/refresh", middlewares.RequireAuth(middlewares.RequireSession(handlers.RefreshToken))).Methods("POST")
+	r.HandleFunc("/unlock", handlers.UnlockAccount).Methods("GET")
+	r.HandleFunc("/verify-email", handlers.VerifyEmail).Methods("GET")
+	r.HandleFunc("/verify-email/resend", middlewares.RequireAuth(middlewares.RequireSession(handlers.ResendVerification))).Methods("POST")
+	r.HandleFunc("/password/forgot", handlers.ForgotPassword).Methods("POST")
+	r.HandleFunc("/password/reset", handlers.ResetPassword).Methods("POST")
+
+	// two-factor authentication
+	r.HandleFunc("/2fa/enroll", middlewares.RequireAuth(middlewares.RequireSession(handlers.Enroll2FA))).Methods("POST")
+	r.HandleFunc("/2fa/confirm", middlewares.RequireAuth(middlewares.RequireSession(handlers.Confirm2FA))).Methods("POST")
+	r.HandleFunc("/2fa", middlewares.RequireAuth(middlewares.RequireSession(handlers.Disable2FA))).Methods("DELETE")
+
+	// passkeys (WebAuthn)
+	r.HandleFunc("/webauthn/login/begin", handlers.BeginPasskeyLogin).Methods("POST")
+	r.HandleFunc("/webauthn/login/finish", handlers.FinishPasskeyLogin).Methods("POST")
+	r.HandleFunc("/webauthn/register/begin", middlewares.RequireAuth(middlewares.RequireSession(handlers.BeginPasskeyRegistration))).Methods("POST")
+	r.HandleFunc("/webauthn/register/finish", middlewares.RequireAuth(middlewares.RequireSession(handlers.FinishPasskeyRegistration))).Methods("POST")
+	r.HandleFunc("/webauthn/credentials", middlewares.RequireAuth(middlewares.RequireSession(handlers.GetPasskeys))).Methods("GET")
+	r.HandleFunc("/webauthn/credentials/{id}", middlewares.RequireAuth(middlewares.RequireSession(handlers.DeletePasskey))).Methods("DELETE")
+
+	// self-service account
+	r.HandleFunc("/me", middlewares.RequireAuth(handlers.GetMe)).Methods("GET")
+	r.HandleFunc("/me", middlewares.RequireAuth(middlewares.RequireSession(handlers.UpdateMe))).Methods("PATCH")
+	r.HandleFunc("/me", middlewares.RequireAuth(middlewares.RequireSession(handlers.DeleteMe))).Methods("DELETE")
+	r.HandleFunc("/me/deletion", middlewares.RequireAuth(middlewares.RequireSession(handlers.CancelDeleteMe))).Methods("DELETE")
+	r.HandleFunc("/me/password", middlewares.RequireAuth(middlewares.RequireSession(handlers.ChangeMyPassword))).Methods("POST")
+	r.HandleFunc("/me/export", middlewares.RequireAuth(middlewares.RequireSession(middlewares.Idempotent(handlers.RequestMyExport)))).Methods("POST")
+	r.HandleFunc("/me/exports", middlewares.RequireAuth(middlewares.RequireSession(handlers.GetMyExports))).Methods("GET")
+	r.HandleFunc("/exports/{id}/download", handlers.DownloadExport).Methods("GET")
+	r.HandleFunc("/me/calendar-feed", middlewares.RequireAuth(middlewares.RequireSession(handlers.CreateCalendarFeed))).Methods("POST")
+	r.HandleFunc("/me/calendar-feed", middlewares.RequireAuth(middlewares.RequireSession(handlers.DeleteCalendarFeed))).Methods("DELETE")
+	r.HandleFunc("/calendar/{token}.ics", handlers.GetCalendarFeed).Methods("GET")
+	r.HandleFunc("/me/sessions", middlewares.RequireAuth(middlewares.RequireSession(handlers.GetMySessions))).Methods("GET")
+	r.HandleFunc("/me/sessions/{id}", middlewares.RequireAuth(middlewares.RequireSession(handlers.RevokeMySession))).Methods("DELETE")
+
+	// personal access tokens
+	r.HandleFunc("/tokens", middlewares.RequireAuth(middlewares.RequireSession(middlewares.IdempotentOnce(handlers.CreatePersonalToken)))).Methods("POST")
+	r.HandleFunc("/tokens", middlewares.RequireAuth(middlewares.RequireSession(handlers.GetPersonalTokens))).Methods("GET")
+	r.HandleFunc("/tokens/{id}", middlewares.RequireAuth(middlewares.RequireSession(handlers.RevokePersonalToken))).Methods("DELETE")
 
 	// tasks handlers
 	// r.HandleFunc("/tasks", taskHandler)
-	r.HandleFunc("/tasks", middlewares.RequireAuth(handlers.CreateTask)).Methods("POST")
-	r.HandleFunc("/tasks", middlewares.RequireAuth(handlers.GetTasks)).Methods("GET")
+	r.HandleFunc("/tasks", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, middlewares.RequireVerified(middlewares.Idempotent(handlers.CreateTask))))).Methods("POST")
+	r.HandleFunc("/tasks", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksRead, handlers.GetTasks))).Methods("GET")
+	r.HandleFunc("/tasks/bulk", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, middlewares.Idempotent(handlers.BulkTasks)))).Methods("POST")
+	r.HandleFunc("/tasks/quick", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, middlewares.RequireVerified(middlewares.Idempotent(handlers.QuickAddTask))))).Methods("POST")
+	r.HandleFunc("/tasks/export", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksRead, handlers.ExportTasks))).Methods("GET")
+	r.HandleFunc("/tasks/import", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, middlewares.RequireVerified(middlewares.Idempotent(handlers.ImportTasks))))).Methods("POST")
+	r.HandleFunc("/tasks/trash", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksRead, handlers.GetTrash))).Methods("GET")
+	r.HandleFunc("/tasks/trash", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, handlers.EmptyTrash))).Methods("DELETE")
+	r.HandleFunc("/tasks/trash/{id}", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, handlers.PurgeTask))).Methods("DELETE")
+	r.HandleFunc("/tasks/{id}/history", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksRead, handlers.GetTaskHistory))).Methods("GET")
+	r.HandleFunc("/tasks/{id}/revisions/{revision}/restore", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, handlers.RevertTask))).Methods("POST")
+	r.HandleFunc("/tasks/{id}/restore", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, handlers.RestoreTask))).Methods("POST")
 	r.HandleFunc("/tasks/{id}", handlers.GetTaskByID).Methods("GET")
-	r.HandleFunc("/tasks/{id}", middlewares.RequireAuth(handlers.UpdateTask)).Methods("PUT")
-	r.HandleFunc("/tasks/{id}", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.DeleteTask))).Methods("DELETE")
+	r.HandleFunc("/tasks/{id}", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, handlers.UpdateTask))).Methods("PUT")
+	r.HandleFunc("/tasks/{id}", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, handlers.PatchTask))).Methods("PATCH")
+	r.HandleFunc("/tasks/{id}", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, middlewares.RequireAdmin(handlers.DeleteTask)))).Methods("DELETE")
 
 	// Admin handlers
 	r.HandleFunc("/admin/users", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.GetAllUsers))).Methods("GET")
@@ -64,19 +133,41 @@ func main() {
 	r.HandleFunc("/admin/users/{id}", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.GetUserByID))).Methods("GET")
 	r.HandleFunc("/admin/users/{id}", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.UpdateUserRole))).Methods("PATCH")
 	r.HandleFunc("/admin/users/{id}", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.DeleteUser))).Methods("DELETE")
+	r.HandleFunc("/admin/users/{id}/deletion-preview", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.PreviewDeleteUser))).Methods("GET")
+	r.HandleFunc("/admin/audit", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.GetAuditEvents))).Methods("GET")
 	r.HandleFunc("/admin/stats", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.GetAdminStats))).Methods("GET")
+	r.HandleFunc("/admin/tokens", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.GetAllPersonalTokens))).Methods("GET")
+	r.HandleFunc("/admin/tokens/{id}", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.AdminRevokePersonalToken))).Methods("DELETE")
+	r.HandleFunc("/admin/users/{id}/export", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.AdminExportUser))).Methods("POST")
 	r.HandleFunc("/admin/users/{id}/ban", middlewares.RequireAuth(middlewares.RequireAdmin(handlers.ToggleBanUser))).Methods("PATCH")
 
 	// File upload handler
-	r.HandleFunc("/upload", middlewares.RequireAuth(handlers.UploadImage)).Methods("POST")
-	r.HandleFunc("/upload-cloud", middlewares.RequireAuth(handlers.UploadToCloudinary)).Methods("POST")
+	r.HandleFunc("/upload", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, handlers.UploadImage))).Methods("POST")
+	r.HandleFunc("/upload-cloud", middlewares.RequireAuth(middlewares.RequireScope(middlewares.ScopeTasksWrite, handlers.UploadToCloudinary))).Methods("POST")
 
 	// CORS config
-	headersOk := gorillaHandlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"})
+	headersOk := gorillaHandlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "If-Match", "If-None-Match", middlewares.IdempotencyKeyHeader, utils.RequestIDHeader})
+	exposedOk := gorillaHandlers.ExposedHeaders([]string{"ETag", "Accept-Patch", "Idempotent-Replayed", utils.RequestIDHeader})
 	originsOk := gorillaHandlers.AllowedOrigins([]string{"3000"})
-	methodsOk := gorillaHandlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
+	methodsOk := gorillaHandlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
+
+	// CalDAV lives outside the CORS wrapper, which answers every OPTIONS
+	// itself: DAV clients send OPTIONS to discover capabilities, and use
+	// methods (PROPFIND, REPORT) it would reject.
+	dav := mux.NewRouter()
+	dav.NotFoundHandler = r.NotFoundHandler
+	dav.HandleFunc("/.well-known/caldav", handlers.CalDAVWellKnown)
+	dav.HandleFunc("/dav/", middlewares.RequireBasicAuth("Tasks", handlers.CalDAVRoot))
+	dav.HandleFunc("/dav/{user}/", middlewares.RequireBasicAuth("Tasks", handlers.CalDAVHome))
+	dav.HandleFunc("/dav/{user}/tasks{slash:/?}", middlewares.RequireBasicAuth("Tasks", handlers.CalDAVCollection))
+	dav.HandleFunc("/dav/{user}/tasks/{name}", middlewares.RequireBasicAuth("Tasks", handlers.CalDAVObject))
+
+	root := http.NewServeMux()
+	root.Handle("/dav/", dav)
+	root.Handle("/.well-known/caldav", dav)
+	root.Handle("/", gorillaHandlers.CORS(originsOk, headersOk, exposedOk, methodsOk)(r))
 
 	fmt.Println("Server starting at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8000", gorillaHandlers.CORS(originsOk, headersOk, methodsOk)(r)))
+	log.Fatal(http.ListenAndServe(":8000", middlewares.RequestID(root)))
 
 }
@@ -6,6 +6,9 @@ import (
 	"os"
 	"strings"
 
+	"task-api/db"
+	"task-api/utils"
+
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
@@ -13,19 +16,27 @@ import (
 type contextKey string
 
 const (
-	userKey contextKey = "userID"
-	roleKey contextKey = "role"
+	userKey    contextKey = "userID"
+	roleKey    contextKey = "role"
+	sessionKey contextKey = "sessionID"
+	mfaKey     contextKey = "mfa"
+	scopesKey  contextKey = "scopes"
 )
 
 func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-			http.Error(w, "Missing token", http.StatusUnauthorized)
+			utils.ErrorCode(w, "Missing token", http.StatusUnauthorized, "token_missing")
 			return
 		}
 
 		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+		if strings.HasPrefix(tokenStr, utils.PersonalTokenPrefix) {
+			requirePersonalToken(next, w, r, tokenStr)
+			return
+		}
+
 		secret := os.Getenv("JWT_SECRET")
 
 		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
@@ -33,33 +44,54 @@ func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 		})
 
 		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			utils.ErrorCode(w, "Invalid token", http.StatusUnauthorized, "invalid_token")
 			return
 		}
 
 		claims, ok := token.Claims.(jwt.MapClaims)
 		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+			utils.ErrorCode(w, "Invalid token claims", http.StatusUnauthorized, "invalid_token")
 			return
 		}
 
 		userIDStr, ok := claims["user_id"].(string)
 		if !ok {
-			http.Error(w, "User ID not found in token", http.StatusUnauthorized)
+			utils.ErrorCode(w, "User ID not found in token", http.StatusUnauthorized, "invalid_token")
 			return
 		}
 
 		userID, err := uuid.Parse(userIDStr)
 		if err != nil {
-			http.Error(w, "Invalid user ID format", http.StatusUnauthorized)
+			utils.ErrorCode(w, "Invalid user ID format", http.StatusUnauthorized, "invalid_token")
 			return
 		}
 
-		role := claims["role"].(string)
+		role, ok := claims["role"].(string)
+		if !ok {
+			utils.ErrorCode(w, "Invalid token claims", http.StatusUnauthorized, "invalid_token")
+			return
+		}
 
-		// Store UUID and role in context
+		// Tokens are tied to a session so they can be revoked server-side
+		sessionIDStr, _ := claims["sid"].(string)
+		var sessionID uuid.UUID
+		var mfa bool
+		err = db.Pool.QueryRow(context.Background(),
+			`UPDATE sessions SET last_seen_at=now()
+			 WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL
+			 RETURNING id, mfa`,
+			sessionIDStr, userID,
+		).Scan(&sessionID, &mfa)
+		if err != nil {
+			utils.ErrorCode(w, "Session expired or revoked", http.StatusUnauthorized, "session_revoked")
+			return
+		}
+
+		// Store UUID, role and session in context
 		ctx := context.WithValue(r.Context(), userKey, userID)
 		ctx = context.WithValue(ctx, roleKey, role)
+		ctx = context.WithValue(ctx, sessionKey, sessionID)
+		ctx = context.WithValue(ctx, mfaKey, mfa)
 
 		next(w, r.WithContext(ctx))
 	}
@@ -80,10 +112,52 @@ func GetUserRole(r *http.Request) string {
 	return ""
 }
 
+func GetSessionID(r *http.Request) uuid.UUID {
+	if sessionID, ok := r.Context().Value(sessionKey).(uuid.UUID); ok {
+		return sessionID
+	}
+	return uuid.Nil
+}
+
+// SessionHasMFA reports whether the current session was established with
+// a second factor.
+func SessionHasMFA(r *http.Request) bool {
+	mfa, _ := r.Context().Value(mfaKey).(bool)
+	return mfa
+}
+
+// AdminRequires2FA is controlled by REQUIRE_ADMIN_2FA.
+func AdminRequires2FA() bool {
+	return os.Getenv("REQUIRE_ADMIN_2FA") == "true"
+}
+
+// ActsAsAdmin reports whether the request passes RequireAdmin, for
+// handlers open to everyone that let admins reach other users' data.
+func ActsAsAdmin(r *http.Request) bool {
+	if GetUserRole(r) != "admin" {
+		return false
+	}
+	if IsPersonalToken(r) {
+		return HasScope(r, ScopeAdmin)
+	}
+	return !AdminRequires2FA() || SessionHasMFA(r)
+}
+
 func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if GetUserRole(r) != "admin" {
-			http.Error(w, "You are unauthourized to view this. Admins only", http.StatusForbidden)
+			utils.ErrorCode(w, "You are unauthourized to view this. Admins only", http.StatusForbidden, "admin_required")
+			return
+		}
+		if IsPersonalToken(r) {
+			// admin:* tokens can only be minted from a session that
+			// already satisfied the 2FA policy
+			if !HasScope(r, ScopeAdmin) {
+				utils.ErrorCode(w, "Token is missing the admin:* scope", http.StatusForbidden, "insufficient_scope")
+				return
+			}
+		} else if AdminRequires2FA() && !SessionHasMFA(r) {
+			utils.ErrorCode(w, "Two-factor authentication is required for admins", http.StatusForbidden, "mfa_required")
 			return
 		}
 		next(w, r)
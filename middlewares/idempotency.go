@@ -0,0 +1,259 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"task-api/db"
+	"task-api/utils"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKey    = 255
+	maxIdempotentBody    = 25 << 20
+)
+
+// IdempotencyTTL is how long a stored response is replayed for, from
+// IDEMPOTENCY_TTL (default 24h).
+func IdempotencyTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// recorder captures a response while passing it through.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Idempotent makes a POST safe to retry. Inside RequireAuth the first
+// response for a user's Idempotency-Key is stored and replayed for later
+// requests with the same key; on a public route keys are scoped to the
+// client's IP address instead. Reusing a key with a different request is
+// a 422. Requests without the header are not affected. 5xx responses are
+// not stored, so they can be retried with the same key.
+func Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return idempotent(next, true)
+}
+
+// IdempotentOnce is Idempotent for responses that carry a secret, which
+// is never stored: a retry of a request that went through gets a 409
+// instead of the response.
+func IdempotentOnce(next http.HandlerFunc) http.HandlerFunc {
+	return idempotent(next, false)
+}
+
+func idempotent(next http.HandlerFunc, replayable bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			utils.ErrorCode(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest, "invalid_idempotency_key")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			utils.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := idempotencyScope(r)
+
+		fingerprint := requestFingerprint(r, body)
+
+		ctx := context.Background()
+
+		// Claim the key; an expired claim is taken over
+		commandTag, err := db.Pool.Exec(ctx,
+			`INSERT INTO idempotency_keys (scope, key, fingerprint, expires_at)
+			 VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (scope, key) DO UPDATE
+			   SET fingerprint=EXCLUDED.fingerprint, status=NULL, headers=NULL, body=NULL, replayable=TRUE,
+			       created_at=now(), expires_at=EXCLUDED.expires_at
+			   WHERE idempotency_keys.expires_at < now()`,
+			scope, key, fingerprint, time.Now().Add(IdempotencyTTL()),
+		)
+		if err != nil {
+			utils.Error(w, "Failed to process request", http.StatusInternalServerError)
+			return
+		}
+
+		if commandTag.RowsAffected() == 0 {
+			replayIdempotent(w, scope, key, fingerprint)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status == 0 || rec.status >= 500 {
+			_, err = db.Pool.Exec(ctx, "DELETE FROM idempotency_keys WHERE scope=$1 AND key=$2", scope, key)
+		} else if !replayable {
+			_, err = db.Pool.Exec(ctx,
+				"UPDATE idempotency_keys SET status=$1, replayable=FALSE WHERE scope=$2 AND key=$3",
+				rec.status, scope, key,
+			)
+		} else {
+			headers := storedHeaders(w.Header())
+			_, err = db.Pool.Exec(ctx,
+				"UPDATE idempotency_keys SET status=$1, headers=$2, body=$3 WHERE scope=$4 AND key=$5",
+				rec.status, headers, rec.body.Bytes(), scope, key,
+			)
+		}
+		if err != nil {
+			log.Printf("Idempotent %s error: %v", r.URL.Path, err)
+		}
+	}
+}
+
+// requestFingerprint identifies a request by what it asks for. A
+// multipart body is hashed part by part, so a retry with a new random
+// boundary still matches.
+func requestFingerprint(r *http.Request, body []byte) string {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n"+mediaType+"\n")
+	if mediaType != "multipart/form-data" || hashMultipart(h, body, params["boundary"]) != nil {
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hashMultipart(w io.Writer, body []byte, boundary string) error {
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%q %q %q %d\n", part.FormName(), part.FileName(), part.Header.Get("Content-Type"), len(content))
+		w.Write(content)
+	}
+}
+
+// idempotencyScope keeps one caller's keys apart from another's: the
+// user, or a hash of the client's IP address when nobody is logged in.
+func idempotencyScope(r *http.Request) string {
+	if userID := GetUserID(r); userID != uuid.Nil {
+		return userID.String()
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	sum := sha256.Sum256([]byte(ip))
+	return "ip:" + hex.EncodeToString(sum[:])
+}
+
+// storedHeaders is the part of a response worth replaying: per-request
+// headers (request id, CORS) are left out so the retry sets its own.
+func storedHeaders(h http.Header) http.Header {
+	stored := http.Header{}
+	for name, values := range h {
+		if name == utils.RequestIDHeader || name == "Vary" || strings.HasPrefix(name, "Access-Control-") {
+			continue
+		}
+		stored[name] = values
+	}
+	return stored
+}
+
+func replayIdempotent(w http.ResponseWriter, scope, key, fingerprint string) {
+	var storedFingerprint string
+	var status *int
+	var headers http.Header
+	var body []byte
+	var replayable bool
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT fingerprint, status, headers, body, replayable FROM idempotency_keys WHERE scope=$1 AND key=$2",
+		scope, key,
+	).Scan(&storedFingerprint, &status, &headers, &body, &replayable)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// The first request failed and released the key in between
+		utils.ErrorCode(w, "The original request failed; retry it", http.StatusConflict, "idempotency_key_in_use")
+		return
+	}
+	if err != nil {
+		utils.Error(w, "Failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	if storedFingerprint != fingerprint {
+		utils.ErrorCode(w, "Idempotency-Key was already used for a different request",
+			http.StatusUnprocessableEntity, "idempotency_key_reused")
+		return
+	}
+	if status == nil {
+		w.Header().Set("Retry-After", "1")
+		utils.ErrorCode(w, "A request with this Idempotency-Key is still being processed",
+			http.StatusConflict, "idempotency_key_in_use")
+		return
+	}
+	if !replayable {
+		utils.ErrorCode(w, "A request with this Idempotency-Key already succeeded; its response is not kept",
+			http.StatusConflict, "idempotency_key_used")
+		return
+	}
+
+	for name, values := range headers {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(*status)
+	w.Write(body)
+}
+
+// PurgeExpiredIdempotencyKeys drops stored responses past their window.
+// It runs on a schedule from main.
+func PurgeExpiredIdempotencyKeys() error {
+	_, err := db.Pool.Exec(context.Background(), "DELETE FROM idempotency_keys WHERE expires_at < now()")
+	return err
+}
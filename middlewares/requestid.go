@@ -0,0 +1,29 @@
+package middlewares
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+
+	"task-api/utils"
+)
+
+// Client-supplied ids are kept only if they look like ids, so they are
+// safe to echo and log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID gives every request an id, echoed in the X-Request-ID
+// response header and in error bodies. A well-formed incoming
+// X-Request-ID is reused so calls can be traced across services.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(utils.RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+			r.Header.Set(utils.RequestIDHeader, id)
+		}
+		w.Header().Set(utils.RequestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
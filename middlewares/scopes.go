@@ -0,0 +1,116 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"task-api/db"
+	"task-api/utils"
+)
+
+const (
+	ScopeTasksRead  = "tasks:read"
+	ScopeTasksWrite = "tasks:write"
+	ScopeAdmin      = "admin:*"
+)
+
+var ValidScopes = []string{ScopeTasksRead, ScopeTasksWrite, ScopeAdmin}
+
+// requirePersonalToken authenticates a personal access token. Its role is
+// always the owner's current role, so demoting a user also demotes their
+// tokens.
+func requirePersonalToken(next http.HandlerFunc, w http.ResponseWriter, r *http.Request, raw string) {
+	ctx, err := personalTokenContext(r, raw)
+	if err != nil {
+		utils.ErrorCode(w, "Invalid token", http.StatusUnauthorized, "invalid_token")
+		return
+	}
+	next(w, r.WithContext(ctx))
+}
+
+func personalTokenContext(r *http.Request, raw string) (context.Context, error) {
+	var userID uuid.UUID
+	var role string
+	var scopes []string
+	err := db.Pool.QueryRow(context.Background(),
+		`UPDATE personal_access_tokens p SET last_used_at=now()
+		 FROM users u
+		 WHERE p.token_hash=$1 AND p.revoked_at IS NULL
+		   AND (p.expires_at IS NULL OR p.expires_at > now())
+		   AND u.id = p.user_id AND NOT u.banned
+		 RETURNING p.user_id, u.role, p.scopes`,
+		utils.HashToken(raw),
+	).Scan(&userID, &role, &scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.WithValue(r.Context(), userKey, userID)
+	ctx = context.WithValue(ctx, roleKey, role)
+	ctx = context.WithValue(ctx, scopesKey, scopes)
+	return ctx, nil
+}
+
+// RequireBasicAuth is RequireAuth for clients that can only send HTTP
+// Basic credentials, such as CalDAV apps. The password must be a personal
+// access token; the user name is not checked. Failures carry a challenge
+// so the client asks for credentials.
+func RequireBasicAuth(realm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, password, ok := r.BasicAuth()
+		if !ok || !strings.HasPrefix(password, utils.PersonalTokenPrefix) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			utils.ErrorCode(w, "Sign in with a personal access token as the password", http.StatusUnauthorized, "token_missing")
+			return
+		}
+
+		ctx, err := personalTokenContext(r, password)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			utils.ErrorCode(w, "Invalid token", http.StatusUnauthorized, "invalid_token")
+			return
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func IsPersonalToken(r *http.Request) bool {
+	_, ok := r.Context().Value(scopesKey).([]string)
+	return ok
+}
+
+// HasScope is always true for interactive sessions; only personal access
+// tokens are scoped.
+func HasScope(r *http.Request, scope string) bool {
+	scopes, ok := r.Context().Value(scopesKey).([]string)
+	if !ok {
+		return true
+	}
+	return slices.Contains(scopes, scope) || slices.Contains(scopes, ScopeAdmin)
+}
+
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !HasScope(r, scope) {
+			utils.ErrorCode(w, "Token is missing the "+scope+" scope", http.StatusForbidden, "insufficient_scope")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireSession keeps personal access tokens away from account
+// management endpoints (2FA, tokens, refresh).
+func RequireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if IsPersonalToken(r) {
+			utils.ErrorCode(w, "This endpoint requires an interactive login", http.StatusForbidden, "interactive_login_required")
+			return
+		}
+		next(w, r)
+	}
+}
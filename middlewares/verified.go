@@ -0,0 +1,47 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"task-api/db"
+	"task-api/utils"
+)
+
+const (
+	UnverifiedAllow = "allow" // unverified accounts behave like verified ones
+	UnverifiedLimit = "limit" // can log in, but can't create tasks
+	UnverifiedBlock = "block" // can't log in until verified
+)
+
+// UnverifiedPolicy reads UNVERIFIED_EMAIL_POLICY, defaulting to "limit".
+func UnverifiedPolicy() string {
+	switch p := os.Getenv("UNVERIFIED_EMAIL_POLICY"); p {
+	case UnverifiedAllow, UnverifiedBlock:
+		return p
+	default:
+		return UnverifiedLimit
+	}
+}
+
+// RequireVerified must run after RequireAuth.
+func RequireVerified(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if UnverifiedPolicy() == UnverifiedAllow {
+			next(w, r)
+			return
+		}
+
+		var verified bool
+		err := db.Pool.QueryRow(context.Background(),
+			"SELECT email_verified FROM users WHERE id=$1", GetUserID(r),
+		).Scan(&verified)
+		if err != nil || !verified {
+			utils.ErrorCode(w, "Please verify your email address first", http.StatusForbidden, "email_unverified")
+			return
+		}
+
+		next(w, r)
+	}
+}
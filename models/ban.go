@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Ban struct {
+	ID        uuid.UUID  `json:"id"`
+	Reason    string     `json:"reason"`
+	BannedBy  *uuid.UUID `json:"banned_by"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	LiftedAt  *time.Time `json:"lifted_at,omitempty"`
+	LiftedBy  *uuid.UUID `json:"lifted_by,omitempty"`
+}
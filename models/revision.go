@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FieldChange is one field's value before and after a revision.
+type FieldChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+type TaskRevision struct {
+	ID        int64                  `json:"id"`
+	TaskID    uuid.UUID              `json:"task_id"`
+	Revision  int                    `json:"revision"`
+	Action    string                 `json:"action"`
+	ActorID   *uuid.UUID             `json:"actor_id"`
+	CreatedAt time.Time              `json:"created_at"`
+	Changes   map[string]FieldChange `json:"changes"`
+	Snapshot  Task                   `json:"snapshot"`
+}
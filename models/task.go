@@ -1,12 +1,23 @@
 package models
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type Task struct {
-	ID       uuid.UUID `json:"id"`
-	Title    string    `json:"title"`
-	Details  string    `json:"details"`
-	Done     bool      `json:"done"`
-	ImageURL string    `json:"image_url"`
-	UserID   uuid.UUID `json:"user_id"`
+	ID         uuid.UUID  `json:"id"`
+	Title      string     `json:"title"`
+	Details    string     `json:"details"`
+	Done       bool       `json:"done"`
+	ImageURL   string     `json:"image_url"`
+	DueAt      *time.Time `json:"due_at"`
+	Tags       []string   `json:"tags"`
+	Recurrence string     `json:"recurrence"`
+	Priority   string     `json:"priority"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Version    int        `json:"version"`
+	ETag       string     `json:"etag,omitempty"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
 }
@@ -1,6 +1,10 @@
 package models
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type User struct {
 	ID       uuid.UUID `json:"id"`
@@ -9,4 +13,27 @@ type User struct {
 	Password string    `json:"password,omitempty"`
 	Role     string    `json:"role"`
 	Banned   bool      `json:"banned"`
+
+	EmailVerified bool    `json:"email_verified"`
+	PendingEmail  *string `json:"pending_email,omitempty"`
+	TOTPEnabled   bool    `json:"totp_enabled"`
+
+	FailedLogins int        `json:"failed_logins"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+
+	Timezone            string     `json:"timezone"`
+	Locale              string     `json:"locale"`
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+
+	Bans []Ban `json:"bans,omitempty"`
+}
+
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	MFA        bool      `json:"mfa"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
 }
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// NormalizeEmail validates a bare address ("a@b.c", no display name) and
+// returns it trimmed and lower-cased so lookups are case-insensitive.
+func NormalizeEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s || addr.Name != "" {
+		return "", ErrInvalidEmail
+	}
+
+	at := strings.LastIndex(s, "@")
+	domain := s[at+1:]
+	if at < 1 || !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", ErrInvalidEmail
+	}
+
+	return strings.ToLower(s), nil
+}
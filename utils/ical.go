@@ -0,0 +1,358 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ICalComponent is an iCalendar (RFC 5545) component such as VCALENDAR
+// or VTODO, with its properties and nested components.
+type ICalComponent struct {
+	Name       string
+	Props      []ICalProp
+	Components []*ICalComponent
+}
+
+// ICalProp is one content line. Value is kept as written: TEXT values
+// are escaped, see ICalText and ICalUnescape.
+type ICalProp struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Add appends a property; params are given as name, value pairs.
+func (c *ICalComponent) Add(name, value string, params ...string) {
+	p := ICalProp{Name: name, Value: value}
+	if len(params) > 0 {
+		p.Params = map[string]string{}
+		for i := 0; i+1 < len(params); i += 2 {
+			p.Params[params[i]] = params[i+1]
+		}
+	}
+	c.Props = append(c.Props, p)
+}
+
+// Prop is the first property called name, or nil.
+func (c *ICalComponent) Prop(name string) *ICalProp {
+	for i := range c.Props {
+		if c.Props[i].Name == name {
+			return &c.Props[i]
+		}
+	}
+	return nil
+}
+
+// All is every property called name, for those that may repeat.
+func (c *ICalComponent) All(name string) []ICalProp {
+	var props []ICalProp
+	for _, p := range c.Props {
+		if p.Name == name {
+			props = append(props, p)
+		}
+	}
+	return props
+}
+
+// Text is the unescaped value of the first property called name, or "".
+func (c *ICalComponent) Text(name string) string {
+	if p := c.Prop(name); p != nil {
+		return ICalUnescape(p.Value)
+	}
+	return ""
+}
+
+// WriteICal writes c and everything in it, with CRLF line endings and
+// long lines folded.
+func WriteICal(w io.Writer, c *ICalComponent) error {
+	bw := bufio.NewWriter(w)
+	writeICalComponent(bw, c)
+	return bw.Flush()
+}
+
+func writeICalComponent(w *bufio.Writer, c *ICalComponent) {
+	writeICalLine(w, "BEGIN:"+c.Name)
+	for _, p := range c.Props {
+		writeICalLine(w, p.String())
+	}
+	for _, child := range c.Components {
+		writeICalComponent(w, child)
+	}
+	writeICalLine(w, "END:"+c.Name)
+}
+
+// writeICalLine folds lines at 75 octets, never inside a UTF-8 sequence.
+// Continuation lines start with a space, which counts towards the limit.
+func writeICalLine(w *bufio.Writer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.WriteString(line[:cut])
+		w.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
+
+func (p ICalProp) String() string {
+	var b strings.Builder
+	b.WriteString(p.Name)
+
+	names := make([]string, 0, len(p.Params))
+	for name := range p.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := p.Params[name]
+		if strings.ContainsAny(value, ":;,") {
+			value = `"` + strings.ReplaceAll(value, `"`, "") + `"`
+		}
+		b.WriteString(";" + name + "=" + value)
+	}
+
+	b.WriteString(":" + p.Value)
+	return b.String()
+}
+
+// ParseICal reads an iCalendar stream into its top-level components,
+// usually a single VCALENDAR.
+func ParseICal(r io.Reader) ([]*ICalComponent, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var top, stack []*ICalComponent
+	for _, line := range lines {
+		p, err := parseICalLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch p.Name {
+		case "BEGIN":
+			c := &ICalComponent{Name: strings.ToUpper(p.Value)}
+			if len(stack) == 0 {
+				top = append(top, c)
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, c)
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(p.Value) {
+				return nil, fmt.Errorf("unexpected END:%s", p.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("%s is outside any component", p.Name)
+			}
+			c := stack[len(stack)-1]
+			c.Props = append(c.Props, p)
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("missing END:%s", stack[len(stack)-1].Name)
+	}
+	if len(top) == 0 {
+		return nil, errors.New("no calendar data")
+	}
+	return top, nil
+}
+
+// parseICalLine splits name;param=value;...:value, allowing quoted
+// parameter values to contain ; and :.
+func parseICalLine(line string) (ICalProp, error) {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			parts = append(parts, line[start:i])
+			start = i + 1
+		case c == ':' && !quoted:
+			parts = append(parts, line[start:i])
+			p := ICalProp{Name: strings.ToUpper(parts[0]), Value: line[i+1:]}
+			if p.Name == "" {
+				return p, fmt.Errorf("invalid content line %q", line)
+			}
+			for _, param := range parts[1:] {
+				name, value, ok := strings.Cut(param, "=")
+				if !ok {
+					return p, fmt.Errorf("invalid parameter %q on %s", param, p.Name)
+				}
+				if p.Params == nil {
+					p.Params = map[string]string{}
+				}
+				p.Params[strings.ToUpper(name)] = strings.Trim(value, `"`)
+			}
+			return p, nil
+		}
+	}
+	return ICalProp{}, fmt.Errorf("invalid content line %q", line)
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", "")
+
+// ICalText escapes s as a TEXT value.
+func ICalText(s string) string {
+	return icalEscaper.Replace(s)
+}
+
+// ICalUnescape reverses ICalText.
+func ICalUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' || s[i] == 'N' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// ICalList splits a multi-valued TEXT value, such as CATEGORIES, on its
+// unescaped commas and unescapes each entry.
+func ICalList(value string) []string {
+	var list []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case ',':
+			list = append(list, ICalUnescape(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(list, ICalUnescape(value[start:]))
+}
+
+const (
+	icalDateLayout     = "20060102"
+	icalDateTimeLayout = "20060102T150405"
+)
+
+// ICalTime formats t as a UTC DATE-TIME value.
+func ICalTime(t time.Time) string {
+	return t.UTC().Format(icalDateTimeLayout + "Z")
+}
+
+// ICalDate formats t as a DATE value.
+func ICalDate(t time.Time) string {
+	return t.Format(icalDateLayout)
+}
+
+// ParseICalTime reads a DATE or DATE-TIME property. Dates are midnight
+// UTC; times with a TZID are read in that zone, and floating times (or
+// an unknown TZID) in loc.
+func ParseICalTime(p ICalProp, loc *time.Location) (time.Time, error) {
+	value := strings.TrimSpace(p.Value)
+	if strings.EqualFold(p.Params["VALUE"], "DATE") || len(value) == len(icalDateLayout) {
+		return time.Parse(icalDateLayout, value)
+	}
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse(icalDateTimeLayout+"Z", value)
+	}
+	if tzid := p.Params["TZID"]; tzid != "" {
+		if zone, err := time.LoadLocation(tzid); err == nil {
+			loc = zone
+		}
+	}
+	return time.ParseInLocation(icalDateTimeLayout, value, loc)
+}
+
+var (
+	rruleFreqs = map[string]bool{
+		"SECONDLY": true, "MINUTELY": true, "HOURLY": true, "DAILY": true, "WEEKLY": true, "MONTHLY": true, "YEARLY": true,
+	}
+	rruleParts = map[string]bool{
+		"FREQ": true, "UNTIL": true, "COUNT": true, "INTERVAL": true, "BYSECOND": true, "BYMINUTE": true, "BYHOUR": true,
+		"BYDAY": true, "BYMONTHDAY": true, "BYYEARDAY": true, "BYWEEKNO": true, "BYMONTH": true, "BYSETPOS": true, "WKST": true,
+	}
+)
+
+// NormalizeRRule checks an RFC 5545 recurrence rule ("FREQ=WEEKLY;BYDAY=MO",
+// optionally prefixed "RRULE:") and returns it upper-cased without the
+// prefix. The BY* lists are not checked beyond being present.
+func NormalizeRRule(rule string) (string, error) {
+	rule = strings.ToUpper(strings.TrimSpace(rule))
+	rule = strings.TrimPrefix(rule, "RRULE:")
+
+	seen := map[string]bool{}
+	for _, part := range strings.Split(rule, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return "", errors.New("must be an iCalendar RRULE such as FREQ=WEEKLY;BYDAY=MO")
+		}
+		if !rruleParts[name] {
+			return "", fmt.Errorf("has an unknown rule part %s", name)
+		}
+		if seen[name] {
+			return "", fmt.Errorf("has %s more than once", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "FREQ":
+			if !rruleFreqs[value] {
+				return "", errors.New("must have a FREQ of DAILY, WEEKLY, MONTHLY, YEARLY, HOURLY, MINUTELY or SECONDLY")
+			}
+		case "COUNT", "INTERVAL":
+			if n, err := strconv.Atoi(value); err != nil || n < 1 {
+				return "", fmt.Errorf("must have a positive whole %s", name)
+			}
+		case "UNTIL":
+			_, dateErr := time.Parse(icalDateLayout, value)
+			_, timeErr := time.Parse(icalDateTimeLayout+"Z", value)
+			if dateErr != nil && timeErr != nil {
+				return "", errors.New("must have an UNTIL date (YYYYMMDD) or UTC date-time (YYYYMMDDTHHMMSSZ)")
+			}
+		}
+	}
+
+	if !seen["FREQ"] {
+		return "", errors.New("must have a FREQ")
+	}
+	if seen["COUNT"] && seen["UNTIL"] {
+		return "", errors.New("cannot have both COUNT and UNTIL")
+	}
+	return rule, nil
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// RequestIDHeader carries the id the RequestID middleware gives each
+// request. Problems repeat it so a client report can be matched to logs.
+const RequestIDHeader = "X-Request-ID"
+
+// Problem is an RFC 7807 problem details body.
+type Problem struct {
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	Status    int               `json:"status"`
+	Detail    string            `json:"detail,omitempty"`
+	Code      string            `json:"code"`
+	RequestID string            `json:"request_id,omitempty"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+// WriteProblem fills in whatever p leaves empty from its status and
+// writes it as application/problem+json.
+func WriteProblem(w http.ResponseWriter, p Problem) {
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Code == "" {
+		p.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(p.Status)), " ", "_")
+	}
+	if p.Type == "" {
+		p.Type = "/problems/" + p.Code
+	}
+	p.RequestID = w.Header().Get(RequestIDHeader)
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// Error replaces http.Error: same arguments, problem+json body. The code
+// is derived from the status.
+func Error(w http.ResponseWriter, detail string, status int) {
+	WriteProblem(w, Problem{Status: status, Detail: detail})
+}
+
+// ErrorCode is Error with a specific machine-readable code, for errors
+// a client is expected to act on.
+func ErrorCode(w http.ResponseWriter, detail string, status int, code string) {
+	WriteProblem(w, Problem{Status: status, Detail: detail, Code: code})
+}
+
+// ValidationError reports per-field problems with the request body.
+func ValidationError(w http.ResponseWriter, detail string, fields map[string]string) {
+	WriteProblem(w, Problem{
+		Status: http.StatusUnprocessableEntity,
+		Detail: detail,
+		Code:   "validation_failed",
+		Errors: fields,
+	})
+}
@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"log"
+	"time"
+)
+
+// RunEvery runs job once now and then on every tick, recovering from
+// panics so one bad run doesn't stop the schedule. Call it with go.
+func RunEvery(interval time.Duration, name string, job func() error) {
+	run := func() {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("%s panicked: %v", name, p)
+			}
+		}()
+		if err := job(); err != nil {
+			log.Printf("%s error: %v", name, err)
+		}
+	}
+
+	run()
+	for range time.Tick(interval) {
+		run()
+	}
+}
@@ -0,0 +1,290 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Just enough of WebAuthn Level 2 for passkey login: "none" and "packed"
+// attestation, ES256/RS256/EdDSA credentials.
+
+const (
+	COSEAlgES256 = -7
+	COSEAlgEdDSA = -8
+	COSEAlgRS256 = -257
+
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttested     = 0x40
+)
+
+var ErrWebAuthn = errors.New("webauthn verification failed")
+
+func webauthnErr(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrWebAuthn, fmt.Sprintf(format, args...))
+}
+
+// DecodeBase64URL accepts base64url with or without padding, which is
+// how browsers and client libraries variously encode WebAuthn buffers.
+func DecodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+type AuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte // COSE_Key, stored as-is
+}
+
+func (a AuthenticatorData) UserVerified() bool {
+	return a.Flags&authFlagUserVerified != 0
+}
+
+func ParseAuthenticatorData(b []byte) (AuthenticatorData, error) {
+	var a AuthenticatorData
+	if len(b) < 37 {
+		return a, webauthnErr("authenticator data too short")
+	}
+
+	a.RPIDHash = b[:32]
+	a.Flags = b[32]
+	a.SignCount = binary.BigEndian.Uint32(b[33:37])
+
+	if a.Flags&authFlagAttested == 0 {
+		return a, nil
+	}
+
+	rest := b[37:]
+	if len(rest) < 18 {
+		return a, webauthnErr("attested credential data too short")
+	}
+	a.AAGUID = rest[:16]
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return a, webauthnErr("credential id truncated")
+	}
+	a.CredentialID = rest[:idLen]
+	rest = rest[idLen:]
+
+	// The COSE key is followed by optional extensions, so decode exactly
+	// one CBOR item to find where it ends
+	var key cbor.RawMessage
+	if err := cbor.NewDecoder(bytes.NewReader(rest)).Decode(&key); err != nil {
+		return a, webauthnErr("credential public key: %v", err)
+	}
+	a.PublicKey = key
+
+	return a, nil
+}
+
+// clientData is the subset of CollectedClientData we check.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// VerifyClientData checks the ceremony type, challenge and origin, and
+// returns the hash the authenticator signed over.
+func VerifyClientData(raw []byte, ceremony string, challenge []byte, origin string) ([]byte, error) {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, webauthnErr("client data: %v", err)
+	}
+	if cd.Type != ceremony {
+		return nil, webauthnErr("unexpected client data type %q", cd.Type)
+	}
+
+	got, err := DecodeBase64URL(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return nil, webauthnErr("challenge mismatch")
+	}
+	if cd.Origin != origin {
+		return nil, webauthnErr("unexpected origin %q", cd.Origin)
+	}
+
+	sum := sha256.Sum256(raw)
+	return sum[:], nil
+}
+
+// CheckRelyingParty verifies the rpIdHash and the user-presence flag.
+func CheckRelyingParty(a AuthenticatorData, rpID string) error {
+	want := sha256.Sum256([]byte(rpID))
+	if subtle.ConstantTimeCompare(a.RPIDHash, want[:]) != 1 {
+		return webauthnErr("rpIdHash mismatch")
+	}
+	if a.Flags&authFlagUserPresent == 0 {
+		return webauthnErr("user not present")
+	}
+	return nil
+}
+
+type attestationObject struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+type packedStmt struct {
+	Alg int64    `cbor:"alg"`
+	Sig []byte   `cbor:"sig"`
+	X5C [][]byte `cbor:"x5c"`
+}
+
+// VerifyAttestation parses an attestationObject, checks its statement and
+// returns the authenticator data holding the new credential.
+func VerifyAttestation(raw, clientDataHash []byte) (AuthenticatorData, string, error) {
+	var obj attestationObject
+	if err := cbor.Unmarshal(raw, &obj); err != nil {
+		return AuthenticatorData{}, "", webauthnErr("attestation object: %v", err)
+	}
+
+	auth, err := ParseAuthenticatorData(obj.AuthData)
+	if err != nil {
+		return auth, "", err
+	}
+	if auth.CredentialID == nil {
+		return auth, "", webauthnErr("no attested credential")
+	}
+
+	switch obj.Fmt {
+	case "none":
+		return auth, obj.Fmt, nil
+
+	case "packed":
+		var stmt packedStmt
+		if err := cbor.Unmarshal(obj.AttStmt, &stmt); err != nil {
+			return auth, "", webauthnErr("packed statement: %v", err)
+		}
+		signed := append(append([]byte{}, obj.AuthData...), clientDataHash...)
+
+		if len(stmt.X5C) == 0 {
+			// Self attestation: signed by the credential key itself
+			key, alg, err := ParseCOSEKey(auth.PublicKey)
+			if err != nil {
+				return auth, "", err
+			}
+			if alg != stmt.Alg {
+				return auth, "", webauthnErr("self attestation algorithm mismatch")
+			}
+			return auth, obj.Fmt, VerifySignature(key, alg, signed, stmt.Sig)
+		}
+
+		cert, err := x509.ParseCertificate(stmt.X5C[0])
+		if err != nil {
+			return auth, "", webauthnErr("attestation certificate: %v", err)
+		}
+		now := time.Now()
+		if cert.Version != 3 || cert.IsCA || now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return auth, "", webauthnErr("attestation certificate is not acceptable")
+		}
+		return auth, obj.Fmt, VerifySignature(cert.PublicKey, stmt.Alg, signed, stmt.Sig)
+
+	default:
+		return auth, "", webauthnErr("unsupported attestation format %q", obj.Fmt)
+	}
+}
+
+type coseHeader struct {
+	Kty int64 `cbor:"1,keyasint"`
+	Alg int64 `cbor:"3,keyasint"`
+}
+
+type coseEC2 struct {
+	Crv int64  `cbor:"-1,keyasint"`
+	X   []byte `cbor:"-2,keyasint"`
+	Y   []byte `cbor:"-3,keyasint"`
+}
+
+type coseRSA struct {
+	N []byte `cbor:"-1,keyasint"`
+	E []byte `cbor:"-2,keyasint"`
+}
+
+type coseOKP struct {
+	Crv int64  `cbor:"-1,keyasint"`
+	X   []byte `cbor:"-2,keyasint"`
+}
+
+// ParseCOSEKey turns a stored COSE_Key into a crypto public key.
+func ParseCOSEKey(raw []byte) (crypto.PublicKey, int64, error) {
+	var h coseHeader
+	if err := cbor.Unmarshal(raw, &h); err != nil {
+		return nil, 0, webauthnErr("COSE key: %v", err)
+	}
+
+	switch h.Kty {
+	case 2: // EC2
+		var k coseEC2
+		if err := cbor.Unmarshal(raw, &k); err != nil || k.Crv != 1 || h.Alg != COSEAlgES256 {
+			return nil, 0, webauthnErr("unsupported EC key")
+		}
+		x, y := new(big.Int).SetBytes(k.X), new(big.Int).SetBytes(k.Y)
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, 0, webauthnErr("EC point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, h.Alg, nil
+
+	case 3: // RSA
+		var k coseRSA
+		if err := cbor.Unmarshal(raw, &k); err != nil || h.Alg != COSEAlgRS256 {
+			return nil, 0, webauthnErr("unsupported RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(k.N), E: int(new(big.Int).SetBytes(k.E).Int64())}, h.Alg, nil
+
+	case 1: // OKP
+		var k coseOKP
+		if err := cbor.Unmarshal(raw, &k); err != nil || k.Crv != 6 || len(k.X) != ed25519.PublicKeySize {
+			return nil, 0, webauthnErr("unsupported OKP key")
+		}
+		return ed25519.PublicKey(k.X), COSEAlgEdDSA, nil
+	}
+
+	return nil, 0, webauthnErr("unsupported key type %d", h.Kty)
+}
+
+func VerifySignature(key crypto.PublicKey, alg int64, data, sig []byte) error {
+	ok := false
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if alg == COSEAlgES256 {
+			sum := sha256.Sum256(data)
+			ok = ecdsa.VerifyASN1(k, sum[:], sig)
+		}
+	case *rsa.PublicKey:
+		if alg == COSEAlgRS256 {
+			sum := sha256.Sum256(data)
+			ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+		}
+	case ed25519.PublicKey:
+		if alg == COSEAlgEdDSA {
+			ok = ed25519.Verify(k, data, sig)
+		}
+	}
+
+	if !ok {
+		return webauthnErr("bad signature")
+	}
+	return nil
+}